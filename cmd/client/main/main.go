@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 	"google.golang.org/grpc/metadata"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
@@ -199,8 +200,8 @@ var controllerCmds = []*cmd{
 	&cmd{
 		Name:    "deletevolume",
 		Aliases: []string{"d", "rm", "del"},
-		Action:  nil,
-		Flags:   nil,
+		Action:  deleteVolume,
+		Flags:   flagsDeleteVolume,
 	},
 	&cmd{
 		Name:    "controllerpublishvolume",
@@ -319,13 +320,17 @@ Use the -? flag with an RPC for additional help.
 //                               Global Flags                                //
 ///////////////////////////////////////////////////////////////////////////////
 var args struct {
-	service   string
-	endpoint  string
-	format    string
-	help      bool
-	insecure  bool
-	szVersion string
-	version   *csi.Version
+	service    string
+	endpoint   string
+	format     string
+	help       bool
+	insecure   bool
+	caCert     string
+	cert       string
+	key        string
+	serverName string
+	szVersion  string
+	version    *csi.Version
 }
 
 func flagsGlobal(
@@ -364,6 +369,30 @@ func flagsGlobal(
 		insecure,
 		"Disables transport security")
 
+	fs.StringVar(
+		&args.caCert,
+		"cacert",
+		os.Getenv("CSI_CACERT"),
+		"The CA file verifying the server certificate, enables TLS")
+
+	fs.StringVar(
+		&args.cert,
+		"cert",
+		os.Getenv("CSI_CERT"),
+		"The client certificate file, enables TLS")
+
+	fs.StringVar(
+		&args.key,
+		"key",
+		os.Getenv("CSI_KEY"),
+		"The client key file")
+
+	fs.StringVar(
+		&args.serverName,
+		"servername",
+		os.Getenv("CSI_SERVER_NAME"),
+		"The name verified in the server certificate, the endpoint host or localhost for a unix endpoint by default")
+
 	fmtMsg := &bytes.Buffer{}
 	fmt.Fprint(fmtMsg, "The Go template used to print an object.")
 	if formatObjectType != "" {
@@ -481,6 +510,64 @@ func createVolume(
 	return nil
 }
 
+///////////////////////////////////////////////////////////////////////////////
+//                              DeleteVolume                                 //
+///////////////////////////////////////////////////////////////////////////////
+var argsDeleteVolume struct {
+	volumeMD mapOfStringArg
+}
+
+func flagsDeleteVolume(ctx context.Context, rpc string) *flag.FlagSet {
+	fs := flag.NewFlagSet(rpc, flag.ExitOnError)
+	flagsGlobal(fs, "", "")
+
+	fs.Var(
+		&argsDeleteVolume.volumeMD,
+		"metadata",
+		"The metadata of the volume, for example its backend.")
+
+	fs.Usage = func() {
+		fmt.Fprintf(
+			os.Stderr,
+			"usage: %s %s [ARGS...] ID\n",
+			appName, rpc)
+		fs.PrintDefaults()
+	}
+
+	return fs
+}
+
+func deleteVolume(
+	ctx context.Context,
+	fs *flag.FlagSet,
+	cc *grpc.ClientConn) error {
+
+	var (
+		client csi.ControllerClient
+
+		id = fs.Arg(0)
+
+		version = args.version
+	)
+
+	if id == "" {
+		return &errUsage{"missing volume ID"}
+	}
+
+	volumeID := &csi.VolumeHandle{Id: id, Metadata: map[string]string{}}
+
+	// check for volume metadata
+	if v := argsDeleteVolume.volumeMD.vals; len(v) > 0 {
+		volumeID.Metadata = v
+	}
+
+	// initialize the csi client
+	client = csi.NewControllerClient(cc)
+
+	// execute the rpc
+	return utils.DeleteVolume(ctx, client, version, volumeID)
+}
+
 ///////////////////////////////////////////////////////////////////////////////
 //                          ControllerPublishVolume                          //
 ///////////////////////////////////////////////////////////////////////////////
@@ -1120,12 +1207,51 @@ func newGrpcClient(ctx context.Context) (*grpc.ClientConn, error) {
 				return net.DialTimeout(proto, addr, timeout)
 			}),
 	}
-	if args.insecure {
+	switch {
+	case args.caCert != "" || args.cert != "" || args.key != "":
+		creds, err := newTLSCredentials(endpoint)
+		if err != nil {
+			return nil, err
+		}
+		dialOpts = append(dialOpts, grpc.WithTransportCredentials(creds))
+	case args.insecure:
 		dialOpts = append(dialOpts, grpc.WithInsecure())
 	}
 	return grpc.DialContext(ctx, endpoint, dialOpts...)
 }
 
+// newTLSCredentials verifies the server certificate against the server name
+func newTLSCredentials(endpoint string) (credentials.TransportCredentials, error) {
+	serverName, err := tlsServerName(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	config, err := utils.NewClientTLSConfig(args.caCert, args.cert, args.key, serverName)
+	if err != nil {
+		return nil, err
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// tlsServerName returns the -servername flag, or the host of a network endpoint
+// and localhost for a unix socket which has no host name to verify
+func tlsServerName(endpoint string) (string, error) {
+	if args.serverName != "" {
+		return args.serverName, nil
+	}
+	proto, addr, err := utils.ParseProtoAddr(endpoint)
+	if err != nil {
+		return "", err
+	}
+	if strings.HasPrefix(strings.ToLower(proto), "unix") {
+		return "localhost", nil
+	}
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host, nil
+	}
+	return addr, nil
+}
+
 // stringSliceArg is used for parsing a csv arg into a string slice
 type stringSliceArg struct {
 	szVal string
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"flag"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/midoblgsm/ubiquity-csi/utils"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+)
+
+// writeCertificate writes name.crt and name.key for localhost and 127.0.0.1, signed by
+// the parent or self signed as a CA when the parent is nil
+func writeCertificate(dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	Expect(err).ToNot(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)).To(Succeed())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+	return cert, key
+}
+
+// connect dials the endpoint with the global flags and returns the state the connection settles in
+func connect() connectivity.State {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	conn, err := newGrpcClient(ctx)
+	Expect(err).ToNot(HaveOccurred())
+	defer conn.Close()
+	conn.Connect()
+	state := conn.GetState()
+	for state != connectivity.Ready && state != connectivity.TransientFailure && conn.WaitForStateChange(ctx, state) {
+		state = conn.GetState()
+	}
+	return state
+}
+
+var _ = Describe("Client", func() {
+
+	var dir string
+	file := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "ubiquity-csi-client")
+		Expect(err).ToNot(HaveOccurred())
+		ca, caKey := writeCertificate(dir, "ca", nil, nil)
+		writeCertificate(dir, "server", ca, caKey)
+		writeCertificate(dir, "client", ca, caKey)
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		flagsGlobal(fs, "", "")
+		Expect(fs.Parse([]string{})).To(Succeed())
+	})
+	AfterEach(func() {
+		os.RemoveAll(dir)
+	})
+
+	Context(".flagsGlobal", func() {
+		It("Should parse the tls flags", func() {
+			fs := flag.NewFlagSet("test", flag.ContinueOnError)
+			flagsGlobal(fs, "", "")
+			Expect(fs.Parse([]string{"-endpoint", "tcp://127.0.0.1:9595", "-cacert", "ca.crt", "-cert", "client.crt", "-key", "client.key", "-servername", "csi.example.com"})).To(Succeed())
+			Expect(args.caCert).To(Equal("ca.crt"))
+			Expect(args.cert).To(Equal("client.crt"))
+			Expect(args.key).To(Equal("client.key"))
+			Expect(args.serverName).To(Equal("csi.example.com"))
+		})
+	})
+
+	Context(".tlsServerName", func() {
+		It("Should verify the host of a network endpoint", func() {
+			Expect(tlsServerName("tcp://127.0.0.1:9595")).To(Equal("127.0.0.1"))
+			Expect(tlsServerName("tcp://csi.example.com:9595")).To(Equal("csi.example.com"))
+		})
+		It("Should verify localhost for a unix endpoint", func() {
+			Expect(tlsServerName("unix:///var/lib/ubiquity-csi/csi.sock")).To(Equal("localhost"))
+		})
+		It("Should verify the server name flag when it is set", func() {
+			args.serverName = "csi.example.com"
+			Expect(tlsServerName("unix:///var/lib/ubiquity-csi/csi.sock")).To(Equal("csi.example.com"))
+		})
+	})
+
+	Context(".newGrpcClient", func() {
+		var server *grpc.Server
+		BeforeEach(func() {
+			config, err := utils.NewServerTLSConfig(file("server.crt"), file("server.key"), file("ca.crt"), true)
+			Expect(err).ToNot(HaveOccurred())
+			server = grpc.NewServer(grpc.Creds(credentials.NewTLS(config)))
+			listener, err := net.Listen("unix", file("csi.sock"))
+			Expect(err).ToNot(HaveOccurred())
+			go server.Serve(listener)
+			args.endpoint = "unix://" + file("csi.sock")
+			args.caCert = file("ca.crt")
+		})
+		AfterEach(func() {
+			server.Stop()
+		})
+		It("Should connect over TLS with the client certificate", func() {
+			args.cert = file("client.crt")
+			args.key = file("client.key")
+			Expect(connect()).To(Equal(connectivity.Ready))
+		})
+		It("Should be rejected without a client certificate", func() {
+			Expect(connect()).To(Equal(connectivity.TransientFailure))
+		})
+		It("Should be rejected when the server name does not match the server certificate", func() {
+			args.cert = file("client.crt")
+			args.key = file("client.key")
+			args.serverName = "csi.example.com"
+			Expect(connect()).To(Equal(connectivity.TransientFailure))
+		})
+	})
+})
@@ -0,0 +1,90 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// backendCapabilities describes the volume capabilities a ubiquity backend can offer
+type backendCapabilities struct {
+	accessModes []csi.VolumeCapability_AccessMode_Mode
+	mount       bool
+	block       bool
+	// fsTypes lists the file systems a mounted volume can be formatted with,
+	// backends exposing a file system of their own only accept an empty fs type
+	fsTypes []string
+}
+
+var (
+	singleNodeAccessModes = []csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+	}
+	multiNodeAccessModes = append([]csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+	}, singleNodeAccessModes...)
+)
+
+// backendCapabilitiesTable holds the capabilities of every ubiquity backend
+var backendCapabilitiesTable = map[string]backendCapabilities{
+	// a directory on the local host
+	"localhost": {
+		accessModes: singleNodeAccessModes,
+		mount:       true,
+	},
+	// a fileset of a shared file system mounted on every node
+	"spectrum-scale": {
+		accessModes: multiNodeAccessModes,
+		mount:       true,
+	},
+	// a block device attached to a single host
+	"scbe": {
+		accessModes: singleNodeAccessModes,
+		mount:       true,
+		block:       true,
+		fsTypes:     []string{"ext4", "xfs"},
+	},
+}
+
+// validateCapability returns an error describing why the backend cannot offer the capability
+func (b backendCapabilities) validateCapability(capability *csi.VolumeCapability) error {
+	if capability == nil {
+		return fmt.Errorf("missing volume capability")
+	}
+	if mode := capability.GetAccessMode().GetMode(); !containsAccessMode(b.accessModes, mode) {
+		return fmt.Errorf("access mode %s is not supported", mode.String())
+	}
+	if capability.GetBlock() != nil && !b.block {
+		return fmt.Errorf("block access is not supported")
+	}
+	if mount := capability.GetMount(); mount != nil {
+		if !b.mount {
+			return fmt.Errorf("mount access is not supported")
+		}
+		if fsType := mount.GetFsType(); fsType != "" && !containsString(b.fsTypes, fsType) {
+			return fmt.Errorf("fs type %s is not supported", fsType)
+		}
+	}
+	return nil
+}
+
+func containsAccessMode(modes []csi.VolumeCapability_AccessMode_Mode, mode csi.VolumeCapability_AccessMode_Mode) bool {
+	for _, m := range modes {
+		if m == mode {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+package controller
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/midoblgsm/ubiquity/resources"
+	"golang.org/x/net/context"
+)
+
+const (
+	mib uint64 = 1024 * 1024
+	gib uint64 = mib * 1024
+
+	// defaultVolumeSize is used when neither the request nor the configuration provide a size
+	defaultVolumeSize = gib
+
+	// capacityCacheTTL is how long the available capacity of a backend is served from the cache
+	capacityCacheTTL = 10 * time.Second
+)
+
+// backendAllocationUnits is the granularity in bytes at which each ubiquity backend provisions volumes
+var backendAllocationUnits = map[string]uint64{
+	"localhost":      mib,
+	"spectrum-scale": mib,
+	"scbe":           gib,
+}
+
+// resolveCapacity picks the size to provision for a capacity range on the given backend.
+// The size satisfies both bounds of the range and is a multiple of the backend allocation unit,
+// an error is returned when no such size exists
+func (c *Controller) resolveCapacity(capacity *csi.CapacityRange, backend string) (uint64, error) {
+	required := capacity.GetRequiredBytes()
+	limit := capacity.GetLimitBytes()
+	if limit != 0 && required > limit {
+		return 0, fmt.Errorf("required bytes %d exceed limit bytes %d", required, limit)
+	}
+
+	size := required
+	if size == 0 {
+		size = c.config.CsiConfig.DefaultVolumeSize
+		if size == 0 {
+			size = defaultVolumeSize
+		}
+		if limit != 0 && size > limit {
+			size = limit
+		}
+	}
+
+	unit, ok := backendAllocationUnits[backend]
+	if !ok {
+		unit = 1
+	}
+	if rounded := roundUp(size, unit); limit == 0 || rounded <= limit {
+		return rounded, nil
+	}
+	// rounding up overflows the limit, the largest allocation below it may still fit the range
+	if rounded := limit / unit * unit; rounded != 0 && rounded >= required {
+		return rounded, nil
+	}
+	return 0, fmt.Errorf("no size between %d and %d bytes is a multiple of the %d bytes allocation unit of backend %s", required, limit, unit, backend)
+}
+
+func roundUp(size, unit uint64) uint64 {
+	if remainder := size % unit; remainder != 0 {
+		return size + unit - remainder
+	}
+	return size
+}
+
+// backendCapacityProviders report the bytes available for new volumes on each ubiquity backend,
+// a provider returns errCapacityUnknown when the backend cannot tell
+var backendCapacityProviders = map[string]func(c *Controller, ctx context.Context) (uint64, error){
+	"localhost":      (*Controller).getLocalhostCapacity,
+	"spectrum-scale": (*Controller).getSpectrumScaleCapacity,
+	"scbe":           (*Controller).getScbeCapacity,
+}
+
+// errCapacityUnknown is returned by the backends that cannot report their capacity, GetCapacity
+// fails for them rather than reporting an empty backend to the scheduler
+var errCapacityUnknown = errors.New("capacity unknown")
+
+type capacityCacheEntry struct {
+	available uint64
+	expires   time.Time
+}
+
+// capacityCall is a provider call in flight, the concurrent requests for the same backend wait for its result
+type capacityCall struct {
+	done      chan struct{}
+	available uint64
+	err       error
+}
+
+// capacityCache keeps the available capacity of the backends for a short while,
+// the CO calls GetCapacity for every scheduling decision
+type capacityCache struct {
+	sync.Mutex
+	entries  map[string]capacityCacheEntry
+	inflight map[string]*capacityCall
+}
+
+func newCapacityCache() *capacityCache {
+	return &capacityCache{entries: make(map[string]capacityCacheEntry), inflight: make(map[string]*capacityCall)}
+}
+
+// getAvailableCapacity returns the bytes available on the backend, from the cache when it is fresh.
+// The cache is not locked while the provider runs, only the known capacities are cached
+func (c *Controller) getAvailableCapacity(ctx context.Context, backend string) (uint64, error) {
+	provider, ok := backendCapacityProviders[backend]
+	if !ok {
+		return 0, fmt.Errorf("capacity reporting is not supported for backend %s", backend)
+	}
+
+	c.capacityCache.Lock()
+	if entry, ok := c.capacityCache.entries[backend]; ok && time.Now().Before(entry.expires) {
+		c.capacityCache.Unlock()
+		return entry.available, nil
+	}
+	call, ok := c.capacityCache.inflight[backend]
+	if ok {
+		c.capacityCache.Unlock()
+		select {
+		case <-call.done:
+			return call.available, call.err
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	call = &capacityCall{done: make(chan struct{})}
+	c.capacityCache.inflight[backend] = call
+	c.capacityCache.Unlock()
+
+	call.available, call.err = provider(c, ctx)
+
+	c.capacityCache.Lock()
+	delete(c.capacityCache.inflight, backend)
+	if call.err == nil {
+		c.capacityCache.entries[backend] = capacityCacheEntry{available: call.available, expires: time.Now().Add(capacityCacheTTL)}
+	}
+	c.capacityCache.Unlock()
+	close(call.done)
+	return call.available, call.err
+}
+
+// getLocalhostCapacity returns the space available to unprivileged users on the file system holding the localhost volumes
+func (c *Controller) getLocalhostCapacity(ctx context.Context) (uint64, error) {
+	localhostPath := c.config.LocalHostConfig.LocalhostPath
+	if localhostPath == "" {
+		return 0, fmt.Errorf("localhostPath is not configured")
+	}
+	return availableBytes(localhostPath)
+}
+
+// getSpectrumScaleCapacity returns the space available on the file system of the spectrum-scale
+// volumes, which is mounted on the same path on every node of the cluster. The capacity is unknown
+// until a volume exists or when the file system is not mounted on this node
+func (c *Controller) getSpectrumScaleCapacity(ctx context.Context) (uint64, error) {
+	var listVolumesResponse resources.ListVolumesResponse
+	if err := c.callUbiquity(ctx, "", "capacity", func() {
+		listVolumesResponse = c.Client.ListVolumes(resources.ListVolumesRequest{})
+	}); err != nil {
+		return 0, err
+	}
+	if listVolumesResponse.Error != nil {
+		return 0, listVolumesResponse.Error
+	}
+	for _, volume := range listVolumesResponse.Volumes {
+		if volume.Backend != "spectrum-scale" {
+			continue
+		}
+		if volume.Mountpoint == "" {
+			var getVolumeResponse resources.GetVolumeResponse
+			if err := c.callUbiquity(ctx, volume.Name, "capacity", func() {
+				getVolumeResponse = c.Client.GetVolume(resources.GetVolumeRequest{Name: volume.Name})
+			}); err != nil {
+				return 0, err
+			}
+			if getVolumeResponse.Error != nil {
+				continue
+			}
+			volume = getVolumeResponse.Volume
+		}
+		if volume.Mountpoint == "" {
+			continue
+		}
+		if _, err := os.Stat(volume.Mountpoint); os.IsNotExist(err) {
+			return 0, errCapacityUnknown
+		}
+		return availableBytes(volume.Mountpoint)
+	}
+	return 0, errCapacityUnknown
+}
+
+// getScbeCapacity reports an unknown capacity, ubiquity does not expose the free space of the scbe storage pools
+func (c *Controller) getScbeCapacity(ctx context.Context) (uint64, error) {
+	return 0, errCapacityUnknown
+}
+
+// availableBytes returns the space available to unprivileged users on the file system of the path
+func availableBytes(path string) (uint64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, fmt.Errorf("failed to stat the file system of %s: %s", path, err.Error())
+	}
+	return stat.Bavail * uint64(stat.Bsize), nil
+}
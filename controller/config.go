@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"github.com/midoblgsm/ubiquity/resources"
+)
+
+//Config is the ubiquity-csi configuration, it extends the ubiquity client
+//configuration with the settings that are specific to the CSI plugin
+type Config struct {
+	resources.UbiquityPluginConfig
+	CsiConfig CsiConfig
+}
+
+//CsiConfig holds the settings of the [CsiConfig] section of the configuration file
+type CsiConfig struct {
+	// DefaultVolumeSize is the size in bytes given to volumes created without a capacity range
+	DefaultVolumeSize uint64
+	NodeIdentity      NodeIdentityConfig
+	// StagingPath holds the global mount of the published volumes, /var/lib/ubiquity-csi/staging when empty
+	StagingPath string
+	// StatePath holds the node publish-state journal, the LogPath when empty, one of them is required
+	StatePath string
+	// ReconcileCleanup cleans up the differences found by the startup reconciliation
+	ReconcileCleanup bool
+	// AdminAddress is the host:port of the read-only admin endpoint, disabled when empty
+	AdminAddress string
+	// TargetRoot is the directory every target path must be under, such as the kubelet pods directory,
+	// only absolute paths without .. are checked when empty
+	TargetRoot   string
+	MountOptions MountOptionsConfig
+	// ShutdownTimeout is how long in seconds a stop signal waits for the in-flight operations, 30 when zero
+	ShutdownTimeout uint64
+	TLS             TLSConfig
+}
+
+//TLSConfig secures the CSI endpoint, it is served without TLS when CertFile is empty
+type TLSConfig struct {
+	// CertFile and KeyFile are the PEM certificate and key of the server, reloaded when they change
+	CertFile string
+	KeyFile  string
+	// ClientCAFile verifies the client certificates against its PEM CAs, they are not asked for when empty
+	ClientCAFile string
+	// RequireClientCert rejects the clients without a certificate signed by the ClientCAFile CAs
+	RequireClientCert bool
+}
+
+//MountOptionsConfig controls the mount flags of the published volumes
+type MountOptionsConfig struct {
+	// Allowed lists the mount options a CO may request, an option without a value allows any value,
+	// noatime, nosuid, nodev, noexec and the other atime and sync options when empty
+	Allowed []string
+	// Defaults maps a backend to the flags every publish of its volumes gets
+	Defaults map[string][]string
+}
+
+//NodeIdentityConfig describes what the node publishes in its node id
+type NodeIdentityConfig struct {
+	// Keys lists the node identifiers to publish: hostname, fqdn, iqn and wwpns, when empty the
+	// hostname and the iqn and wwpns found on the node
+	Keys []string
+	// Labels are custom key/value pairs added to the node id
+	Labels map[string]string
+	// Hosts maps iqn, wwpn or label values to the host names known by ubiquity
+	Hosts map[string]string
+}
+
+// stateDir is the directory of the node publish-state journal
+func (c Config) stateDir() string {
+	if c.CsiConfig.StatePath != "" {
+		return c.CsiConfig.StatePath
+	}
+	return c.LogPath
+}
@@ -4,35 +4,56 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+
+	"golang.org/x/net/context"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
+	csi_utils "github.com/midoblgsm/ubiquity-csi/utils"
 	"github.com/midoblgsm/ubiquity/remote"
 	"github.com/midoblgsm/ubiquity/resources"
 	"github.com/midoblgsm/ubiquity/utils"
 )
 
+// attachedToHostKey is the volume config key used by ubiquity to report the host a volume is attached to
+const attachedToHostKey = "attach-to"
+
 //Controller this is a structure that controls volume management
 type Controller struct {
 	Client resources.StorageClient
 	Name   string
 	logger *log.Logger
 	exec   utils.Executor
+	config Config
+
+	capacityCache *capacityCache
+	stagingRefs   *stagingRefs
+	journal       *publishJournal
+	volumeLocks   *volumeLocks
+	interrupted   *interruptedOperations
+
+	reconcileState reconcileState
 }
 
 //NewController allows to instantiate a controller
-func NewController(logger *log.Logger, name string, storageApiURL string, config resources.UbiquityPluginConfig) (*Controller, error) {
+func NewController(logger *log.Logger, name string, storageApiURL string, config Config) (*Controller, error) {
+	// the staging mounts and the attachments are released with the last target of a volume,
+	// which the plugin only knows after a restart from its publish-state journal
+	if config.stateDir() == "" {
+		return nil, fmt.Errorf("statePath or logPath is required to keep the node publish state")
+	}
 
-	remoteClient, err := remote.NewRemoteClient(logger, storageApiURL, config)
+	remoteClient, err := remote.NewRemoteClient(logger, storageApiURL, config.UbiquityPluginConfig)
 	if err != nil {
 		return nil, err
 	}
-	return &Controller{logger: logger, Name: name, Client: remoteClient, exec: utils.NewExecutor()}, nil
+	return &Controller{logger: logger, Name: name, Client: remoteClient, exec: utils.NewExecutor(), config: config, capacityCache: newCapacityCache(), stagingRefs: newStagingRefs(), journal: newPublishJournal(config.stateDir()), volumeLocks: newVolumeLocks(), interrupted: newInterruptedOperations()}, nil
 }
 
 //NewControllerWithClient is made for unit testing purposes where we can pass a fake client
-func NewControllerWithClient(logger *log.Logger, client resources.StorageClient, exec utils.Executor) *Controller {
+func NewControllerWithClient(logger *log.Logger, client resources.StorageClient, exec utils.Executor, config Config) *Controller {
 	utils.NewExecutor()
-	return &Controller{logger: logger, Client: client, exec: exec}
+	return &Controller{logger: logger, Client: client, exec: exec, config: config, capacityCache: newCapacityCache(), stagingRefs: newStagingRefs(), journal: newPublishJournal(config.stateDir()), volumeLocks: newVolumeLocks(), interrupted: newInterruptedOperations()}
 }
 
 //ControllerServer interface
@@ -46,77 +67,286 @@ func NewControllerWithClient(logger *log.Logger, client resources.StorageClient,
 //GetCapacity(context.Context, *GetCapacityRequest) (*GetCapacityResponse, error)
 //ControllerGetCapabilities(context.Context, *ControllerGetCapabilitiesRequest) (*ControllerGetCapabilitiesResponse, error)
 //}
-func (c *Controller) CreateVolume(request csi.CreateVolumeRequest) (csi.CreateVolumeResponse, error) {
+func (c *Controller) CreateVolume(ctx context.Context, request csi.CreateVolumeRequest) (csi.CreateVolumeResponse, error) {
 	c.logger.Printf("Entering-controller-create-volume")
 	defer c.logger.Printf("Exiting-controller-create-volume")
 	c.logger.Printf("CSI-create-volume-request-%#v\n", request)
-	in := &resources.CreateVolumeRequest{}
-	opts := make(map[string]string)
-	//// set the volume size
-	var capacity *csi.CapacityRange
-	if capacity = request.GetCapacityRange(); capacity != nil {
-		opts["quota"] = fmt.Sprintf("%d", capacity.LimitBytes)
-		opts["size"] = fmt.Sprintf("%d", capacity.LimitBytes)
+	if !c.volumeLocks.tryLock(request.GetName()) {
+		return *csi_utils.ErrCreateVolume(csi.Error_CreateVolumeError_OPERATION_PENDING_FOR_VOLUME, operationPendingMessage(request.GetName())), nil
 	}
+	defer c.volumeLocks.unlock(request.GetName())
+	c.resumeInterrupted(request.GetName(), "create")
+	in := &resources.CreateVolumeRequest{}
 	//
-	//// set additional options
+	//// set additional options, validated against the backend parameter schema
 	params := request.GetParameters()
-	for k, v := range params {
-		opts[k] = v
+	backend := params[backendParameterKey]
+	if backend == "" && len(c.config.Backends) > 0 {
+		backend = c.config.Backends[0]
+	}
+	opts, err := validateParameters(backend, params)
+	if err == nil && len(c.config.Backends) > 0 && !containsString(c.config.Backends, backend) {
+		err = newInvalidParameterError("backend %s is not enabled", backend)
+	}
+	if err != nil {
+		c.logger.Printf("error-validate-parameters-%#v", err)
+		return *csi_utils.ErrCreateVolume(csi.Error_CreateVolumeError_INVALID_PARAMETER, err.Error()), nil
 	}
 	//
 	in.Name = request.GetName()
-	in.Backend = request.Parameters["backend"]
+	in.Backend = backend
+	//// set the volume size
+	capacity := request.GetCapacityRange()
+	size, err := c.resolveCapacity(capacity, in.Backend)
+	if err != nil {
+		c.logger.Printf("error-resolve-capacity-%#v", err)
+		return *csi_utils.ErrCreateVolume(csi.Error_CreateVolumeError_UNSUPPORTED_CAPACITY_RANGE, err.Error()), nil
+	}
+	opts["quota"] = fmt.Sprintf("%d", size)
+	opts["size"] = fmt.Sprintf("%d", size)
 	in.Metadata = opts
+
+	// the CO retries CreateVolume until it gets an answer, a volume created by
+	// a previous attempt is returned as is when it matches the request
+	var getVolumeResponse resources.GetVolumeResponse
+	if err := c.callUbiquity(ctx, in.Name, "create", func() {
+		getVolumeResponse = c.Client.GetVolume(resources.GetVolumeRequest{Name: in.Name})
+	}); err != nil {
+		return csi.CreateVolumeResponse{}, err
+	}
+	c.logger.Printf("ubiquity-get-volume-response-%#v\n", getVolumeResponse)
+	if getVolumeResponse.Error == nil {
+		existing := getVolumeResponse.Volume
+		if err := isCompatibleVolume(existing, in.Backend, capacity, params); err != nil {
+			msg := fmt.Sprintf("volume %s already exists: %s", in.Name, err.Error())
+			c.logger.Println(msg)
+			return *csi_utils.ErrCreateVolume(csi.Error_CreateVolumeError_VOLUME_ALREADY_EXISTS, msg), nil
+		}
+		csiResponse := newCreateVolumeResponse(existing, existing.CapacityBytes)
+		c.logger.Printf("CSI-create-volume-response-%#v\n", csiResponse)
+		return csiResponse, nil
+	}
+	if !isNotFoundError(getVolumeResponse.Error) {
+		c.logger.Printf("error-get-volume-%#v", getVolumeResponse.Error)
+		return csi.CreateVolumeResponse{}, getVolumeResponse.Error
+	}
+
 	c.logger.Printf("ubiquity-create-volume-request-%#v\n", in)
-	createVolumeResponse := c.Client.CreateVolume(*in)
+	var createVolumeResponse resources.CreateVolumeResponse
+	if err := c.callUbiquity(ctx, in.Name, "create", func() {
+		createVolumeResponse = c.Client.CreateVolume(*in)
+	}); err != nil {
+		return csi.CreateVolumeResponse{}, err
+	}
 	c.logger.Printf("ubiquity-create-volume-response-%#v\n", createVolumeResponse)
 	if createVolumeResponse.Error != nil {
 		c.logger.Printf("error-create-volume-%#v", createVolumeResponse.Error)
 		return csi.CreateVolumeResponse{}, createVolumeResponse.Error
 	}
 
-	handle := csi.VolumeHandle{Id: createVolumeResponse.Volume.Name,
-		Metadata: map[string]string{"backend": createVolumeResponse.Volume.Backend}}
-	volumeInfo := csi.VolumeInfo{CapacityBytes: capacity.LimitBytes,
+	// report what the backend provisioned when it tells us, what we asked for otherwise
+	provisioned := createVolumeResponse.Volume.CapacityBytes
+	if provisioned == 0 {
+		provisioned = size
+	}
+	csiResponse := newCreateVolumeResponse(createVolumeResponse.Volume, provisioned)
+	c.logger.Printf("CSI-create-volume-response-%#v\n", csiResponse)
+	return csiResponse, nil
+
+}
+
+func newCreateVolumeResponse(volume resources.Volume, capacityBytes uint64) csi.CreateVolumeResponse {
+	handle := csi.VolumeHandle{Id: volume.Name,
+		Metadata: map[string]string{"backend": volume.Backend}}
+	volumeInfo := csi.VolumeInfo{CapacityBytes: capacityBytes,
 		Handle: &handle,
 	}
-	csiResponse := csi.CreateVolumeResponse{
+	return csi.CreateVolumeResponse{
 		Reply: &csi.CreateVolumeResponse_Result_{
 			Result: &csi.CreateVolumeResponse_Result{
 				VolumeInfo: &volumeInfo,
 			},
 		},
 	}
-	c.logger.Printf("CSI-create-volume-response-%#v\n", csiResponse)
-	return csiResponse, nil
+}
 
+// isCompatibleVolume checks that an existing volume satisfies a create request,
+// it returns an error describing the first mismatch found
+func isCompatibleVolume(volume resources.Volume, backend string, capacity *csi.CapacityRange, params map[string]string) error {
+	if backend != "" && volume.Backend != "" && backend != volume.Backend {
+		return fmt.Errorf("it belongs to backend %s instead of %s", volume.Backend, backend)
+	}
+	if capacity != nil && volume.CapacityBytes != 0 {
+		if volume.CapacityBytes < capacity.RequiredBytes {
+			return fmt.Errorf("its capacity %d is smaller than the required %d bytes", volume.CapacityBytes, capacity.RequiredBytes)
+		}
+		if capacity.LimitBytes != 0 && volume.CapacityBytes > capacity.LimitBytes {
+			return fmt.Errorf("its capacity %d exceeds the limit of %d bytes", volume.CapacityBytes, capacity.LimitBytes)
+		}
+	}
+	for k, v := range params {
+		if existing, ok := volume.Metadata.Values[k]; ok && existing != v {
+			return fmt.Errorf("its parameter %s is %s instead of %s", k, existing, v)
+		}
+	}
+	return nil
 }
 
-//TODO implement this method
-func (c *Controller) DeleteVolume(request csi.DeleteVolumeRequest) (csi.DeleteVolumeResponse, error) {
+//DeleteVolume removes the volume referenced by the volume handle from its ubiquity backend
+func (c *Controller) DeleteVolume(ctx context.Context, request csi.DeleteVolumeRequest) (csi.DeleteVolumeResponse, error) {
 	c.logger.Printf("Entering-controller-delete-volume")
 	defer c.logger.Printf("Exiting-controller-delete-volume")
-	return csi.DeleteVolumeResponse{}, nil
+	c.logger.Printf("CSI-delete-volume-request-%#v\n", request)
+	handle := request.GetVolumeHandle()
+	if handle.GetId() == "" {
+		return *csi_utils.ErrDeleteVolume(csi.Error_DeleteVolumeError_INVALID_VOLUME_ID, "missing volume handle id"), nil
+	}
+	if !c.volumeLocks.tryLock(handle.Id) {
+		return *csi_utils.ErrDeleteVolume(csi.Error_DeleteVolumeError_OPERATION_PENDING_FOR_VOLUME, operationPendingMessage(handle.Id)), nil
+	}
+	defer c.volumeLocks.unlock(handle.Id)
+	c.resumeInterrupted(handle.Id, "delete")
+	deleted := csi.DeleteVolumeResponse{
+		Reply: &csi.DeleteVolumeResponse_Result_{
+			Result: &csi.DeleteVolumeResponse_Result{},
+		},
+	}
+
+	var getVolumeResponse resources.GetVolumeResponse
+	if err := c.callUbiquity(ctx, handle.Id, "delete", func() {
+		getVolumeResponse = c.Client.GetVolume(resources.GetVolumeRequest{Name: handle.Id})
+	}); err != nil {
+		return csi.DeleteVolumeResponse{}, err
+	}
+	c.logger.Printf("ubiquity-get-volume-response-%#v\n", getVolumeResponse)
+	if getVolumeResponse.Error != nil {
+		if isNotFoundError(getVolumeResponse.Error) {
+			// the volume is already gone, deleting it again is a no-op
+			c.logger.Printf("volume %s does not exist, nothing to delete", handle.Id)
+			c.interrupted.forget(handle.Id)
+			return deleted, nil
+		}
+		if isNotAuthorizedError(getVolumeResponse.Error) {
+			return *csi_utils.ErrDeleteVolume(csi.Error_DeleteVolumeError_CALLER_NOT_AUTHORIZED, getVolumeResponse.Error.Error()), nil
+		}
+		return csi.DeleteVolumeResponse{}, getVolumeResponse.Error
+	}
+	volume := getVolumeResponse.Volume
+	if backend, ok := handle.Metadata["backend"]; ok && backend != "" && backend != volume.Backend {
+		msg := fmt.Sprintf("volume %s does not exist on backend %s", handle.Id, backend)
+		c.logger.Println(msg)
+		return *csi_utils.ErrDeleteVolume(csi.Error_DeleteVolumeError_VOLUME_DOES_NOT_EXIST, msg), nil
+	}
+
+	attachment, err := c.getVolumeAttachment(ctx, volume, "delete")
+	if err != nil {
+		return csi.DeleteVolumeResponse{}, err
+	}
+	if attachment != "" {
+		msg := fmt.Sprintf("volume %s is still attached [%s]", handle.Id, attachment)
+		c.logger.Println(msg)
+		return *csi_utils.ErrDeleteVolume(csi.Error_DeleteVolumeError_VOLUME_IN_USE, msg), nil
+	}
+
+	var removeVolumeResponse resources.RemoveVolumeResponse
+	if err := c.callUbiquity(ctx, handle.Id, "delete", func() {
+		removeVolumeResponse = c.Client.RemoveVolume(resources.RemoveVolumeRequest{Name: handle.Id})
+	}); err != nil {
+		return csi.DeleteVolumeResponse{}, err
+	}
+	c.logger.Printf("ubiquity-remove-volume-response-%#v\n", removeVolumeResponse)
+	if removeVolumeResponse.Error != nil {
+		c.logger.Printf("error-remove-volume-%#v", removeVolumeResponse.Error)
+		if isNotFoundError(removeVolumeResponse.Error) {
+			c.interrupted.forget(handle.Id)
+			return deleted, nil
+		}
+		if isNotAuthorizedError(removeVolumeResponse.Error) {
+			return *csi_utils.ErrDeleteVolume(csi.Error_DeleteVolumeError_CALLER_NOT_AUTHORIZED, removeVolumeResponse.Error.Error()), nil
+		}
+		return csi.DeleteVolumeResponse{}, removeVolumeResponse.Error
+	}
+	c.interrupted.forget(handle.Id)
+	c.logger.Printf("CSI-delete-volume-response-%#v\n", deleted)
+	return deleted, nil
+}
+
+// getVolumeAttachment returns where the volume is attached, or an empty string
+// when the volume is not in use. Mountpoint based backends (localhost, spectrum-scale)
+// report a mountpoint while attached, block backends (scbe) report the host in the volume config
+func (c *Controller) getVolumeAttachment(ctx context.Context, volume resources.Volume, operation string) (string, error) {
+	if volume.Mountpoint != "" {
+		return volume.Mountpoint, nil
+	}
+	var getVolumeConfigResponse resources.GetVolumeConfigResponse
+	if err := c.callUbiquity(ctx, volume.Name, operation, func() {
+		getVolumeConfigResponse = c.Client.GetVolumeConfig(resources.GetVolumeConfigRequest{Name: volume.Name})
+	}); err != nil {
+		return "", err
+	}
+	if getVolumeConfigResponse.Error != nil {
+		if isNotFoundError(getVolumeConfigResponse.Error) {
+			return "", nil
+		}
+		return "", getVolumeConfigResponse.Error
+	}
+	if host, ok := getVolumeConfigResponse.VolumeConfig[attachedToHostKey].(string); ok {
+		return host, nil
+	}
+	return "", nil
 }
 
-func (c *Controller) Attach(request csi.ControllerPublishVolumeRequest) (csi.ControllerPublishVolumeResponse, error) {
+//Attach attaches the volume to the node through ubiquity and publishes the resulting mountpoint
+func (c *Controller) Attach(ctx context.Context, request csi.ControllerPublishVolumeRequest) (csi.ControllerPublishVolumeResponse, error) {
 	c.logger.Printf("Entering-controller-attach-volume")
 	defer c.logger.Printf("Exiting-controller-attach-volume")
+	c.logger.Printf("CSI-attach-volume-request-%#v\n", request)
+	volumeID := request.GetVolumeHandle().GetId()
+	if volumeID == "" {
+		return *csi_utils.ErrControllerPublishVolume(csi.Error_ControllerPublishVolumeError_INVALID_VOLUME_ID, "missing volume handle id"), nil
+	}
+	if !c.volumeLocks.tryLock(volumeID) {
+		return *csi_utils.ErrControllerPublishVolume(csi.Error_ControllerPublishVolumeError_OPERATION_PENDING_FOR_VOLUME, operationPendingMessage(volumeID)), nil
+	}
+	defer c.volumeLocks.unlock(volumeID)
+	c.resumeInterrupted(volumeID, "attach")
 	nid := request.GetNodeId()
 	if nid == nil {
-		//	// INVALID_NODE_ID
-		return csi.ControllerPublishVolumeResponse{}, fmt.Errorf("missing node id")
+		return *csi_utils.ErrControllerPublishVolume(csi.Error_ControllerPublishVolumeError_INVALID_NODE_ID, "missing node id"), nil
 	}
-	hostname, ok := nid.Values["hostname"]
-	if !ok {
-		return csi.ControllerPublishVolumeResponse{}, fmt.Errorf("missing hostname")
-
+	hostname, err := c.resolveNodeHost(nid)
+	if err != nil {
+		return *csi_utils.ErrControllerPublishVolume(csi.Error_ControllerPublishVolumeError_INVALID_NODE_ID, err.Error()), nil
+	}
+	backend := request.GetVolumeHandle().GetMetadata()["backend"]
+	if caps, ok := backendCapabilitiesTable[backend]; ok && request.GetVolumeCapability().GetBlock() != nil && !caps.block {
+		msg := fmt.Sprintf("backend %s does not support block access", backend)
+		return *csi_utils.ErrControllerPublishVolume(csi.Error_ControllerPublishVolumeError_UNSUPPORTED_VOLUME_TYPE, msg), nil
+	}
+	attachRequest := resources.AttachRequest{Name: volumeID, Host: hostname}
+	c.logger.Printf("ubiquity-attach-request-%#v\n", attachRequest)
+	var attachResponse resources.AttachResponse
+	if err := c.callUbiquity(ctx, volumeID, "attach", func() {
+		attachResponse = c.Client.Attach(attachRequest)
+	}); err != nil {
+		return csi.ControllerPublishVolumeResponse{}, err
+	}
+	c.logger.Printf("ubiquity-attach-response-%#v\n", attachResponse)
+	if attachResponse.Error != nil {
+		c.logger.Printf("error-attach-volume-%#v", attachResponse.Error)
+		if code, ok := attachErrorCode(attachResponse.Error); ok {
+			msg := fmt.Sprintf("failed to attach volume %s to %s: %s", volumeID, hostname, attachResponse.Error.Error())
+			return *csi_utils.ErrControllerPublishVolume(code, msg), nil
+		}
+		return csi.ControllerPublishVolumeResponse{}, attachResponse.Error
+	}
+	if attachResponse.Mountpoint == "" {
+		return csi.ControllerPublishVolumeResponse{}, fmt.Errorf("ubiquity attached volume %s to %s without a mountpoint", volumeID, hostname)
 	}
-	attachRequest := resources.AttachRequest{Name: request.VolumeHandle.Id, Host: hostname}
-	attachResponse := c.Client.Attach(attachRequest)
 	values := make(map[string]string)
 	values["mountpoint"] = attachResponse.Mountpoint
+	// ubiquity attaches volumes read-write, the node enforces read-only access when it publishes the volume
+	values["readonly"] = strconv.FormatBool(request.GetReadonly())
 	publishVolumeInfo := csi.PublishVolumeInfo{Values: values}
 	result := csi.ControllerPublishVolumeResponse_Result{PublishVolumeInfo: &publishVolumeInfo}
 	reply := csi.ControllerPublishVolumeResponse_Result_{Result: &result}
@@ -124,23 +354,41 @@ func (c *Controller) Attach(request csi.ControllerPublishVolumeRequest) (csi.Con
 	return csi.ControllerPublishVolumeResponse{Reply: &reply}, nil
 }
 
-func (c *Controller) Detach(request csi.ControllerUnpublishVolumeRequest) (csi.ControllerUnpublishVolumeResponse, error) {
+func (c *Controller) Detach(ctx context.Context, request csi.ControllerUnpublishVolumeRequest) (csi.ControllerUnpublishVolumeResponse, error) {
 	c.logger.Printf("Entering-controller-detach-volume")
 	defer c.logger.Printf("Exiting-controller-detach-volume")
+	if request.GetVolumeHandle().GetId() == "" {
+		return *csi_utils.ErrControllerUnpublishVolume(csi.Error_ControllerUnpublishVolumeError_INVALID_VOLUME_ID, "missing volume id"), nil
+	}
+	if !c.volumeLocks.tryLock(request.VolumeHandle.Id) {
+		return *csi_utils.ErrControllerUnpublishVolume(csi.Error_ControllerUnpublishVolumeError_OPERATION_PENDING_FOR_VOLUME, operationPendingMessage(request.VolumeHandle.Id)), nil
+	}
+	defer c.volumeLocks.unlock(request.VolumeHandle.Id)
+	c.resumeInterrupted(request.VolumeHandle.Id, "detach")
 	nid := request.GetNodeId()
 	if nid == nil {
-		//	// INVALID_NODE_ID
-		return csi.ControllerUnpublishVolumeResponse{}, fmt.Errorf("missing node id")
+		return *csi_utils.ErrControllerUnpublishVolume(csi.Error_ControllerUnpublishVolumeError_NODE_ID_REQUIRED, "missing node id"), nil
 	}
 	//
-	hostname, ok := nid.Values["hostname"]
-	if !ok {
-		//	// INVALID_NODE_ID
-		return csi.ControllerUnpublishVolumeResponse{}, fmt.Errorf("missing node id")
+	hostname, err := c.resolveNodeHost(nid)
+	if err != nil {
+		return *csi_utils.ErrControllerUnpublishVolume(csi.Error_ControllerUnpublishVolumeError_INVALID_NODE_ID, err.Error()), nil
 	}
 	detachRequest := resources.DetachRequest{Name: request.VolumeHandle.Id, Host: hostname}
-	detachResponse := c.Client.Detach(detachRequest)
-	if detachResponse.Error != nil {
+	var detachResponse resources.DetachResponse
+	if err := c.callUbiquity(ctx, detachRequest.Name, "detach", func() {
+		detachResponse = c.Client.Detach(detachRequest)
+	}); err != nil {
+		return csi.ControllerUnpublishVolumeResponse{}, err
+	}
+	// the node detaches a volume with its last target, a volume already detached is not an error,
+	// a volume attached to another node is
+	if detachResponse.Error != nil && !errorContainsAny(detachResponse.Error, notAttachedErrorMessages) {
+		c.logger.Printf("error-detach-volume-%#v", detachResponse.Error)
+		if code, ok := detachErrorCode(detachResponse.Error); ok {
+			msg := fmt.Sprintf("failed to detach volume %s from %s: %s", detachRequest.Name, hostname, detachResponse.Error.Error())
+			return *csi_utils.ErrControllerUnpublishVolume(code, msg), nil
+		}
 		return csi.ControllerUnpublishVolumeResponse{}, detachResponse.Error
 	}
 	reply := csi.ControllerUnpublishVolumeResponse_Result_{}
@@ -148,23 +396,35 @@ func (c *Controller) Detach(request csi.ControllerUnpublishVolumeRequest) (csi.C
 	return csi.ControllerUnpublishVolumeResponse{Reply: &reply}, nil
 }
 
-func (c *Controller) ListVolumes(request csi.ListVolumesRequest) (csi.ListVolumesResponse, error) {
+//ListVolumes returns the ubiquity volumes one page at a time, in name order
+func (c *Controller) ListVolumes(ctx context.Context, request csi.ListVolumesRequest) (csi.ListVolumesResponse, error) {
 	c.logger.Printf("Entering-controller-list-volumes")
 	defer c.logger.Printf("Exiting-controller-list-volumes")
 	c.logger.Printf("CSI-list-volumes-request: %#v\n", request)
 	listVolumesRequest := resources.ListVolumesRequest{}
-	listVolumesResponse := c.Client.ListVolumes(listVolumesRequest)
-	c.logger.Println("ubiquity-list-volumes-response: %#v", listVolumesResponse)
+	var listVolumesResponse resources.ListVolumesResponse
+	if err := c.callUbiquity(ctx, "", "list", func() {
+		listVolumesResponse = c.Client.ListVolumes(listVolumesRequest)
+	}); err != nil {
+		return csi.ListVolumesResponse{}, err
+	}
+	c.logger.Printf("ubiquity-list-volumes-response: %#v\n", listVolumesResponse)
 	if listVolumesResponse.Error != nil {
 		return csi.ListVolumesResponse{}, listVolumesResponse.Error
 	}
 
+	volumes, nextToken, err := pageVolumes(listVolumesResponse.Volumes, request.GetStartingToken(), request.GetMaxEntries())
+	if err != nil {
+		c.logger.Printf("error-list-volumes-%#v", err)
+		return *csi_utils.ErrListVolumes(csi.Error_GeneralError_UNDEFINED, err.Error()), nil
+	}
+
 	reply := csi.ListVolumesResponse_Result_{}
-	reply.Result = &csi.ListVolumesResponse_Result{}
+	reply.Result = &csi.ListVolumesResponse_Result{NextToken: nextToken}
 
-	reply.Result.Entries = make([]*csi.ListVolumesResponse_Result_Entry, len(listVolumesResponse.Volumes))
+	reply.Result.Entries = make([]*csi.ListVolumesResponse_Result_Entry, len(volumes))
 
-	for x, volume := range listVolumesResponse.Volumes {
+	for x, volume := range volumes {
 		reply.Result.Entries[x] = &csi.ListVolumesResponse_Result_Entry{VolumeInfo: &csi.VolumeInfo{}}
 
 		c.logger.Printf("Entry %#v \n", reply.Result.Entries[x].VolumeInfo)
@@ -175,22 +435,109 @@ func (c *Controller) ListVolumes(request csi.ListVolumesRequest) (csi.ListVolume
 		reply.Result.Entries[x].VolumeInfo.CapacityBytes = volume.CapacityBytes
 
 	}
-	c.logger.Println("csi-list-volumes-reply: %#v", reply)
+	c.logger.Printf("csi-list-volumes-reply: %#v\n", reply)
 
 	return csi.ListVolumesResponse{Reply: &reply}, nil
 }
 
-func (c *Controller) ValidateCapabilities(request csi.ValidateVolumeCapabilitiesRequest) (csi.ValidateVolumeCapabilitiesResponse, error) {
+//ValidateCapabilities checks the requested capabilities against the capabilities of the volume backend
+func (c *Controller) ValidateCapabilities(ctx context.Context, request csi.ValidateVolumeCapabilitiesRequest) (csi.ValidateVolumeCapabilitiesResponse, error) {
+	c.logger.Printf("Entering-controller-validate-capabilities")
+	defer c.logger.Printf("Exiting-controller-validate-capabilities")
+	c.logger.Printf("CSI-validate-capabilities-request-%#v\n", request)
+	handle := request.GetVolumeInfo().GetHandle()
+	if handle.GetId() == "" {
+		return *csi_utils.ErrValidateVolumeCapabilities(csi.Error_ValidateVolumeCapabilitiesError_INVALID_VOLUME_INFO, "missing volume handle id"), nil
+	}
+
+	var getVolumeResponse resources.GetVolumeResponse
+	if err := c.callUbiquity(ctx, handle.Id, "validate", func() {
+		getVolumeResponse = c.Client.GetVolume(resources.GetVolumeRequest{Name: handle.Id})
+	}); err != nil {
+		return csi.ValidateVolumeCapabilitiesResponse{}, err
+	}
+	c.logger.Printf("ubiquity-get-volume-response-%#v\n", getVolumeResponse)
+	if getVolumeResponse.Error != nil {
+		if isNotFoundError(getVolumeResponse.Error) {
+			msg := fmt.Sprintf("volume %s does not exist", handle.Id)
+			return *csi_utils.ErrValidateVolumeCapabilities(csi.Error_ValidateVolumeCapabilitiesError_VOLUME_DOES_NOT_EXIST, msg), nil
+		}
+		return csi.ValidateVolumeCapabilitiesResponse{}, getVolumeResponse.Error
+	}
+	backend := getVolumeResponse.Volume.Backend
+	if backend == "" {
+		backend = handle.Metadata["backend"]
+	}
+
+	supported, msg := true, fmt.Sprintf("volume %s on backend %s supports the requested capabilities", handle.Id, backend)
+	capabilities, ok := backendCapabilitiesTable[backend]
+	if !ok {
+		supported, msg = false, fmt.Sprintf("unknown backend %s for volume %s", backend, handle.Id)
+	}
+	for _, capability := range request.GetVolumeCapabilities() {
+		if !supported {
+			break
+		}
+		if err := capabilities.validateCapability(capability); err != nil {
+			supported, msg = false, fmt.Sprintf("volume %s on backend %s: %s", handle.Id, backend, err.Error())
+		} else if _, err := c.mountFlags(backend, capability.GetMount().GetMountFlags()); err != nil {
+			supported, msg = false, fmt.Sprintf("volume %s on backend %s: %s", handle.Id, backend, err.Error())
+		}
+	}
 
-	return csi.ValidateVolumeCapabilitiesResponse{}, nil
+	csiResponse := csi.ValidateVolumeCapabilitiesResponse{
+		Reply: &csi.ValidateVolumeCapabilitiesResponse_Result_{
+			Result: &csi.ValidateVolumeCapabilitiesResponse_Result{
+				Supported: supported,
+				Message:   msg,
+			},
+		},
+	}
+	c.logger.Printf("CSI-validate-capabilities-response-%#v\n", csiResponse)
+	return csiResponse, nil
 }
 
-func (c *Controller) GetCapacity(request csi.GetCapacityRequest) (csi.GetCapacityResponse, error) {
+//GetCapacity reports the bytes available on the backend selected by the request parameters
+func (c *Controller) GetCapacity(ctx context.Context, request csi.GetCapacityRequest) (csi.GetCapacityResponse, error) {
+	c.logger.Printf("Entering-controller-get-capacity")
+	defer c.logger.Printf("Exiting-controller-get-capacity")
+	c.logger.Printf("CSI-get-capacity-request-%#v\n", request)
+	backend := request.GetParameters()["backend"]
+	if backend == "" && len(c.config.Backends) > 0 {
+		backend = c.config.Backends[0]
+	}
+	if len(c.config.Backends) > 0 && !containsString(c.config.Backends, backend) {
+		msg := fmt.Sprintf("backend %s is not enabled", backend)
+		c.logger.Println(msg)
+		return *csi_utils.ErrGetCapacity(csi.Error_GeneralError_UNDEFINED, msg), nil
+	}
+
+	available, err := c.getAvailableCapacity(ctx, backend)
+	if isContextError(err) {
+		return csi.GetCapacityResponse{}, err
+	}
+	if err == errCapacityUnknown {
+		msg := fmt.Sprintf("the capacity of backend %s is unknown", backend)
+		c.logger.Println(msg)
+		return *csi_utils.ErrGetCapacity(csi.Error_GeneralError_UNDEFINED, msg), nil
+	}
+	if err != nil {
+		c.logger.Printf("error-get-capacity-%#v", err)
+		return *csi_utils.ErrGetCapacity(csi.Error_GeneralError_UNDEFINED, err.Error()), nil
+	}
 
-	return csi.GetCapacityResponse{}, nil
+	csiResponse := csi.GetCapacityResponse{
+		Reply: &csi.GetCapacityResponse_Result_{
+			Result: &csi.GetCapacityResponse_Result{
+				AvailableCapacity: available,
+			},
+		},
+	}
+	c.logger.Printf("CSI-get-capacity-response-%#v\n", csiResponse)
+	return csiResponse, nil
 }
 
-func (c *Controller) ControllerGetCapabilities(request csi.ControllerGetCapabilitiesRequest) (csi.ControllerGetCapabilitiesResponse, error) {
+func (c *Controller) ControllerGetCapabilities(ctx context.Context, request csi.ControllerGetCapabilitiesRequest) (csi.ControllerGetCapabilitiesResponse, error) {
 
 	return csi.ControllerGetCapabilitiesResponse{
 		Reply: &csi.ControllerGetCapabilitiesResponse_Result_{
@@ -234,7 +581,7 @@ func (c *Controller) ControllerGetCapabilities(request csi.ControllerGetCapabili
 	}, nil
 }
 
-func (c *Controller) GetSupportedVersions(request csi.GetSupportedVersionsRequest) (csi.GetSupportedVersionsResponse, error) {
+func (c *Controller) GetSupportedVersions(ctx context.Context, request csi.GetSupportedVersionsRequest) (csi.GetSupportedVersionsResponse, error) {
 	return csi.GetSupportedVersionsResponse{
 		Reply: &csi.GetSupportedVersionsResponse_Result_{
 			Result: &csi.GetSupportedVersionsResponse_Result{
@@ -250,58 +597,415 @@ func (c *Controller) GetSupportedVersions(request csi.GetSupportedVersionsReques
 	}, nil
 }
 
-func (c *Controller) GetPluginInfos(request csi.GetPluginInfoRequest) (csi.GetPluginInfoResponse, error) {
+func (c *Controller) GetPluginInfos(ctx context.Context, request csi.GetPluginInfoRequest) (csi.GetPluginInfoResponse, error) {
+	manifest, err := c.parametersManifest()
+	if err != nil {
+		return csi.GetPluginInfoResponse{}, err
+	}
 
 	return csi.GetPluginInfoResponse{
 		Reply: &csi.GetPluginInfoResponse_Result_{
 			Result: &csi.GetPluginInfoResponse_Result{
 				Name:          c.Name,
 				VendorVersion: "0.1.0",
-				Manifest:      nil,
+				Manifest:      manifest,
 			},
 		},
 	}, nil
 }
 
-func (c *Controller) Mount(request csi.NodePublishVolumeRequest) (csi.NodePublishVolumeResponse, error) {
-	return csi.NodePublishVolumeResponse{}, nil
+//Mount bind mounts the mountpoint published by Attach on the target path
+func (c *Controller) Mount(ctx context.Context, request csi.NodePublishVolumeRequest) (response csi.NodePublishVolumeResponse, err error) {
+	c.logger.Printf("Entering-controller-mount")
+	defer c.logger.Printf("Exiting-controller-mount")
+	c.logger.Printf("CSI-node-publish-volume-request-%#v\n", request)
+	volumeID := request.GetVolumeHandle().GetId()
+	if volumeID == "" {
+		return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_INVALID_VOLUME_ID, "missing volume id"), nil
+	}
+	if !c.volumeLocks.tryLock(volumeID) {
+		return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_OPERATION_PENDING_FOR_VOLUME, operationPendingMessage(volumeID)), nil
+	}
+	defer c.volumeLocks.unlock(volumeID)
+	targetPath := request.GetTargetPath()
+	if targetPath == "" {
+		return *csi_utils.ErrNodePublishVolumeGeneral(csi.Error_GeneralError_MISSING_REQUIRED_FIELD, "missing target path"), nil
+	}
+	if targetPath, err = c.validateTargetPath(targetPath); err != nil {
+		return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_MOUNT_ERROR, err.Error()), nil
+	}
+	capability := request.GetVolumeCapability()
+	if capability == nil {
+		return *csi_utils.ErrNodePublishVolumeGeneral(csi.Error_GeneralError_MISSING_REQUIRED_FIELD, "missing volume capability"), nil
+	}
+	block := capability.GetBlock() != nil
+	if !block && capability.GetMount() == nil {
+		return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_UNSUPPORTED_VOLUME_TYPE, "missing access type"), nil
+	}
+	backend := request.GetVolumeHandle().GetMetadata()["backend"]
+	if caps, ok := backendCapabilitiesTable[backend]; ok && block && !caps.block {
+		msg := fmt.Sprintf("backend %s does not support block access", backend)
+		return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_UNSUPPORTED_VOLUME_TYPE, msg), nil
+	}
+	fsType := capability.GetMount().GetFsType()
+	if caps, ok := backendCapabilitiesTable[backend]; ok && fsType != "" && !containsString(caps.fsTypes, fsType) {
+		msg := fmt.Sprintf("backend %s does not support fs type %s", backend, fsType)
+		return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_UNSUPPORTED_FS_TYPE, msg), nil
+	}
+	mountFlags, err := c.mountFlags(backend, capability.GetMount().GetMountFlags())
+	if err != nil {
+		return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_UNSUPPORTED_MOUNT_FLAGS, err.Error()), nil
+	}
+	publishInfo := request.GetPublishVolumeInfo().GetValues()
+	mountpoint := publishInfo["mountpoint"]
+	if mountpoint == "" {
+		msg := fmt.Sprintf("missing mountpoint of volume %s, it must be published by ControllerPublishVolume first", volumeID)
+		return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_MOUNT_ERROR, msg), nil
+	}
+	// ubiquity cannot attach read-only, the readonly flag of the publish info is enforced here
+	readonly := request.GetReadonly() || publishInfo["readonly"] == "true"
+
+	mountpointInfo, err := c.exec.Stat(mountpoint)
+	if err != nil {
+		if c.exec.IsNotExist(err) {
+			msg := fmt.Sprintf("mountpoint %s of volume %s does not exist", mountpoint, volumeID)
+			return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_VOLUME_DOES_NOT_EXIST, msg), nil
+		}
+		return csi.NodePublishVolumeResponse{}, err
+	}
+
+	published := csi.NodePublishVolumeResponse{
+		Reply: &csi.NodePublishVolumeResponse_Result_{
+			Result: &csi.NodePublishVolumeResponse_Result{},
+		},
+	}
+
+	// the target is journaled before it is touched so that a restart can recover it
+	previous, existed := c.journal.get(targetPath)
+	if existed && previous.VolumeID != volumeID {
+		msg := fmt.Sprintf("target path %s is used by volume %s", targetPath, previous.VolumeID)
+		return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_MOUNT_ERROR, msg), nil
+	}
+	// a publish interrupted by its context is rolled back before it is retried
+	if c.resumeInterrupted(volumeID, "publish") && existed && previous.State == statePublishing {
+		c.logger.Printf("rolling-back-interrupted-publish-of-volume-%s-on-%s", volumeID, targetPath)
+		if err := c.rollbackPublish(previous); err != nil {
+			return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_MOUNT_ERROR, err.Error()), nil
+		}
+		previous, existed = publishEntry{}, false
+	}
+	entry := publishEntry{VolumeID: volumeID, Backend: backend, Mountpoint: mountpoint,
+		TargetPath: targetPath, Readonly: readonly, Block: block, FsType: fsType,
+		MountFlags: capability.GetMount().GetMountFlags(), State: statePublishing}
+	if !block {
+		entry.StagingPath = c.stagingPath(volumeID)
+	}
+	if err := c.journal.put(entry); err != nil {
+		return csi.NodePublishVolumeResponse{}, err
+	}
+	defer func() {
+		if isContextError(err) {
+			// the entry stays publishing for the retry to roll it back
+			return
+		}
+		if err != nil || response.GetError() != nil {
+			if restoreErr := c.journal.restore(targetPath, previous, existed); restoreErr != nil {
+				c.logger.Printf("error-restore-journal-of-%s-%#v", targetPath, restoreErr)
+				response, err = csi.NodePublishVolumeResponse{}, restoreErr
+			}
+			return
+		}
+		entry.State = statePublished
+		if err = c.journal.put(entry); err != nil {
+			response = csi.NodePublishVolumeResponse{}
+		}
+	}()
+
+	if err := c.checkContext(ctx, volumeID, "publish"); err != nil {
+		return csi.NodePublishVolumeResponse{}, err
+	}
+	mounted, err := c.isMounted(targetPath)
+	if err != nil {
+		return csi.NodePublishVolumeResponse{}, err
+	}
+	if mounted {
+		if err := c.checkPublishedTarget(volumeID, targetPath, mountpoint, mountpointInfo, block, readonly); err != nil {
+			c.logger.Printf("error-check-published-target-%#v", err)
+			return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_MOUNT_ERROR, err.Error()), nil
+		}
+		c.logger.Printf("target-%s-already-mounted", targetPath)
+		c.stagingRefs.add(volumeID, targetPath)
+		return published, nil
+	}
+
+	if block {
+		// the device is exposed raw, the file system ubiquity mounted on it is unmounted first
+		device, ubiquityMounted, err := c.volumeDevice(volumeID, mountpoint, mountpointInfo)
+		if err == nil {
+			_, err = c.checkDeviceMounts(volumeID, device, mountpoint)
+		}
+		if err == nil {
+			entry.Device = device
+			if mountpointInfo.Mode()&os.ModeDevice == 0 {
+				entry.UbiquityMountpoint = mountpoint
+			}
+			if ubiquityMounted {
+				if err := c.journal.put(entry); err != nil {
+					return csi.NodePublishVolumeResponse{}, err
+				}
+				err = c.unmountUbiquityMount(device, mountpoint)
+			}
+		}
+		if err == nil {
+			if err = c.bindMountDevice(device, targetPath, readonly); err != nil && c.stagingRefs.count(volumeID) == 0 {
+				if restoreErr := c.restoreUbiquityMount(entry); restoreErr != nil {
+					c.logger.Printf("error-restore-ubiquity-mount-%#v", restoreErr)
+				}
+			}
+		}
+		if err != nil {
+			c.logger.Printf("error-mount-device-%#v", err)
+			return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_MOUNT_ERROR, err.Error()), nil
+		}
+		c.stagingRefs.add(volumeID, targetPath)
+		return published, nil
+	}
+
+	// a block backed volume is formatted on first use with the requested fs type
+	deviceMountpoint := mountpointInfo.Mode()&os.ModeDevice != 0
+	var device string
+	if caps := backendCapabilitiesTable[backend]; fsType != "" && (caps.block || deviceMountpoint) {
+		if device, err = c.prepareFilesystem(volumeID, mountpoint, mountpointInfo, fsType); err != nil {
+			c.logger.Printf("error-ensure-filesystem-%#v", err)
+			if _, ok := err.(*fsMismatchError); ok {
+				return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_UNSUPPORTED_FS_TYPE, err.Error()), nil
+			}
+			return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_MOUNT_ERROR, err.Error()), nil
+		}
+	}
+
+	if deviceMountpoint && device == "" {
+		// ubiquity attached the device without mounting it
+		msg := fmt.Sprintf("volume %s is attached as device %s, a fs type is required to mount it", volumeID, mountpoint)
+		return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_UNSUPPORTED_FS_TYPE, msg), nil
+	}
+
+	// the volume is mounted once on the node and bind mounted in every target
+	if err := c.checkContext(ctx, volumeID, "publish"); err != nil {
+		return csi.NodePublishVolumeResponse{}, err
+	}
+	stagingPath, err := c.stageVolume(volumeID, mountpoint, mountpointInfo, device, fsType, mountFlags)
+	if err != nil {
+		c.logger.Printf("error-stage-volume-%#v", err)
+		return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_MOUNT_ERROR, err.Error()), nil
+	}
+	if err := c.exec.MkdirAll(targetPath, targetPathPerm); err != nil {
+		msg := fmt.Sprintf("failed to create target path %s: %s", targetPath, err.Error())
+		return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_MOUNT_ERROR, msg), nil
+	}
+	if err := c.checkContext(ctx, volumeID, "publish"); err != nil {
+		return csi.NodePublishVolumeResponse{}, err
+	}
+	// the file system options were applied by the staging mount, a bind remount only applies per-mount options
+	if err := c.bindMount(stagingPath, targetPath, readonly, perMountFlags(mountFlags)); err != nil {
+		c.logger.Printf("error-mount-%#v", err)
+		return *csi_utils.ErrNodePublishVolume(csi.Error_NodePublishVolumeError_MOUNT_ERROR, err.Error()), nil
+	}
+	c.stagingRefs.add(volumeID, targetPath)
+	return published, nil
 }
 
-func (c *Controller) Unount(request csi.NodeUnpublishVolumeRequest) (csi.NodeUnpublishVolumeResponse, error) {
-	return csi.NodeUnpublishVolumeResponse{}, nil
-	//id, ok := req.GetVolumeId().GetValues()["id"]
-	//if !ok {
-	//// VOLUME_DOES_NOT_EXIST
-	//return csi.Error_NodePublishVolumeError{ErrorCode: 2, ErrorDescription: "missing id val"}, nil
-	//}
-	//
-	//_ = id
-	//
-	//return &csi.NodeUnpublishVolumeResponse{
-	//Reply: &csi.NodeUnpublishVolumeResponse_Result_{
-	//Result: &csi.NodeUnpublishVolumeResponse_Result{},
-	//},
-	//}, nil
+//Unount unmounts the volume from the target path and removes the target directory
+func (c *Controller) Unount(ctx context.Context, request csi.NodeUnpublishVolumeRequest) (response csi.NodeUnpublishVolumeResponse, err error) {
+	c.logger.Printf("Entering-controller-unmount")
+	defer c.logger.Printf("Exiting-controller-unmount")
+	c.logger.Printf("CSI-node-unpublish-volume-request-%#v\n", request)
+	volumeID := request.GetVolumeHandle().GetId()
+	if volumeID == "" {
+		return *csi_utils.ErrNodeUnpublishVolume(csi.Error_NodeUnpublishVolumeError_INVALID_VOLUME_ID, "missing volume id"), nil
+	}
+	if !c.volumeLocks.tryLock(volumeID) {
+		return *csi_utils.ErrNodeUnpublishVolume(csi.Error_NodeUnpublishVolumeError_OPERATION_PENDING_FOR_VOLUME, operationPendingMessage(volumeID)), nil
+	}
+	defer c.volumeLocks.unlock(volumeID)
+	c.resumeInterrupted(volumeID, "unpublish")
+	targetPath := request.GetTargetPath()
+	if targetPath == "" {
+		return *csi_utils.ErrNodeUnpublishVolumeGeneral(csi.Error_GeneralError_MISSING_REQUIRED_FIELD, "missing target path"), nil
+	}
+	if targetPath, err = c.validateTargetPath(targetPath); err != nil {
+		return *csi_utils.ErrNodeUnpublishVolume(csi.Error_NodeUnpublishVolumeError_UNMOUNT_ERROR, err.Error()), nil
+	}
+	unpublished := csi.NodeUnpublishVolumeResponse{
+		Reply: &csi.NodeUnpublishVolumeResponse_Result_{
+			Result: &csi.NodeUnpublishVolumeResponse_Result{},
+		},
+	}
+
+	// only the targets journaled by Mount for the volume are unmounted or removed
+	previous, existed := c.journal.get(targetPath)
+	if existed && previous.VolumeID != volumeID {
+		msg := fmt.Sprintf("target path %s is used by volume %s, refusing to unpublish it", targetPath, previous.VolumeID)
+		return *csi_utils.ErrNodeUnpublishVolume(csi.Error_NodeUnpublishVolumeError_UNMOUNT_ERROR, msg), nil
+	}
+	if !existed && !c.journal.persistent() {
+		// an in-memory journal lost the targets published before a restart, a mounted
+		// target is unpublished once it is checked below to be a mount of the volume
+		mounted, err := c.isMounted(targetPath)
+		if err != nil {
+			return csi.NodeUnpublishVolumeResponse{}, err
+		}
+		if mounted {
+			c.logger.Printf("target-%s-not-journaled-unpublishing-mounted-target", targetPath)
+			previous = publishEntry{VolumeID: volumeID, TargetPath: targetPath}
+		}
+	}
+	if !existed && previous.TargetPath == "" {
+		if _, err := c.exec.Stat(targetPath); err != nil {
+			if c.exec.IsNotExist(err) {
+				c.logger.Printf("target-%s-already-removed", targetPath)
+				return c.unpublishedTarget(ctx, volumeID, targetPath, unpublished)
+			}
+			return csi.NodeUnpublishVolumeResponse{}, err
+		}
+		msg := fmt.Sprintf("target path %s was not published by the plugin, refusing to unpublish it", targetPath)
+		return *csi_utils.ErrNodeUnpublishVolume(csi.Error_NodeUnpublishVolumeError_UNMOUNT_ERROR, msg), nil
+	}
+	entry := previous
+	entry.State = stateUnpublishing
+	if err := c.journal.put(entry); err != nil {
+		return csi.NodeUnpublishVolumeResponse{}, err
+	}
+	defer func() {
+		if isContextError(err) {
+			// the entry stays unpublishing for the retry to finish the unpublish
+			return
+		}
+		if err != nil || response.GetError() != nil {
+			if restoreErr := c.journal.restore(targetPath, previous, existed); restoreErr != nil {
+				c.logger.Printf("error-restore-journal-of-%s-%#v", targetPath, restoreErr)
+				response, err = csi.NodeUnpublishVolumeResponse{}, restoreErr
+			}
+			return
+		}
+		if err = c.journal.delete(targetPath); err != nil {
+			response = csi.NodeUnpublishVolumeResponse{}
+		}
+	}()
+
+	targetInfo, err := c.exec.Stat(targetPath)
+	if err != nil {
+		if c.exec.IsNotExist(err) {
+			c.logger.Printf("target-%s-already-removed", targetPath)
+			return c.unpublishedTarget(ctx, volumeID, targetPath, unpublished)
+		}
+		return csi.NodeUnpublishVolumeResponse{}, err
+	}
+	mounted, err := c.isMounted(targetPath)
+	if err != nil {
+		return csi.NodeUnpublishVolumeResponse{}, err
+	}
+
+	if mounted {
+		// never unmount something that is not the volume, the root of a bind
+		// mount is the same file as the mountpoint of the volume
+		var getVolumeResponse resources.GetVolumeResponse
+		if err := c.callUbiquity(ctx, volumeID, "unpublish", func() {
+			getVolumeResponse = c.Client.GetVolume(resources.GetVolumeRequest{Name: volumeID})
+		}); err != nil {
+			return csi.NodeUnpublishVolumeResponse{}, err
+		}
+		if getVolumeResponse.Error != nil {
+			if isNotFoundError(getVolumeResponse.Error) {
+				return *csi_utils.ErrNodeUnpublishVolume(csi.Error_NodeUnpublishVolumeError_VOLUME_DOES_NOT_EXIST, getVolumeResponse.Error.Error()), nil
+			}
+			return csi.NodeUnpublishVolumeResponse{}, getVolumeResponse.Error
+		}
+		mountpoint := getVolumeResponse.Volume.Mountpoint
+		if mountpoint == "" {
+			msg := fmt.Sprintf("volume %s is not attached to this node, refusing to unmount %s", volumeID, targetPath)
+			return *csi_utils.ErrNodeUnpublishVolume(csi.Error_NodeUnpublishVolumeError_UNMOUNT_ERROR, msg), nil
+		}
+		mountpointInfo, err := c.exec.Stat(mountpoint)
+		if err == nil && mountpointInfo.Mode()&os.ModeDevice != 0 && targetInfo.IsDir() {
+			// the file system of a device attached without a mountpoint, mounted by Mount
+			var source string
+			if source, err = c.mountSource(targetPath); err == nil {
+				targetInfo, err = c.exec.Stat(source)
+			}
+		} else if err == nil && targetInfo.Mode()&os.ModeDevice != 0 {
+			// a block volume, the target is a bind mount of the device of the volume
+			var device string
+			if device, _, err = c.volumeDevice(volumeID, mountpoint, mountpointInfo); err == nil {
+				mountpointInfo, err = c.exec.Stat(device)
+			}
+		}
+		if err != nil || !os.SameFile(targetInfo, mountpointInfo) {
+			msg := fmt.Sprintf("%s is not a mount of volume %s, refusing to unmount it", targetPath, volumeID)
+			return *csi_utils.ErrNodeUnpublishVolume(csi.Error_NodeUnpublishVolumeError_UNMOUNT_ERROR, msg), nil
+		}
+		if err := c.checkContext(ctx, volumeID, "unpublish"); err != nil {
+			return csi.NodeUnpublishVolumeResponse{}, err
+		}
+		if out, err := c.exec.Execute("umount", []string{targetPath}); err != nil {
+			msg := fmt.Sprintf("failed to unmount %s: %s: %s", targetPath, err.Error(), string(out))
+			c.logger.Println(msg)
+			return *csi_utils.ErrNodeUnpublishVolume(csi.Error_NodeUnpublishVolumeError_UNMOUNT_ERROR, msg), nil
+		}
+	}
+
+	if err := c.exec.Remove(targetPath); err != nil && !c.exec.IsNotExist(err) {
+		msg := fmt.Sprintf("failed to remove target path %s: %s", targetPath, err.Error())
+		c.logger.Println(msg)
+		return *csi_utils.ErrNodeUnpublishVolume(csi.Error_NodeUnpublishVolumeError_UNMOUNT_ERROR, msg), nil
+	}
+	return c.unpublishedTarget(ctx, volumeID, targetPath, unpublished)
 }
-func (c *Controller) GetNodeID(request csi.GetNodeIDRequest) (csi.GetNodeIDResponse, error) {
-	hostname, err := os.Hostname()
+
+// unpublishedTarget releases the volume with its last target once the target is gone
+func (c *Controller) unpublishedTarget(ctx context.Context, volumeID string, targetPath string, unpublished csi.NodeUnpublishVolumeResponse) (csi.NodeUnpublishVolumeResponse, error) {
+	if err := c.releaseTarget(ctx, volumeID, targetPath); err != nil {
+		if isContextError(err) {
+			return csi.NodeUnpublishVolumeResponse{}, err
+		}
+		c.logger.Printf("error-release-volume-%#v", err)
+		return *csi_utils.ErrNodeUnpublishVolume(csi.Error_NodeUnpublishVolumeError_UNMOUNT_ERROR, err.Error()), nil
+	}
+	return unpublished, nil
+}
+
+//GetNodeID returns the identifiers of the local node as configured in the node identity section
+func (c *Controller) GetNodeID(ctx context.Context, request csi.GetNodeIDRequest) (csi.GetNodeIDResponse, error) {
+	c.logger.Printf("Entering-controller-get-node-id")
+	defer c.logger.Printf("Exiting-controller-get-node-id")
+	nodeID, err := c.buildNodeID()
 	if err != nil {
+		c.logger.Printf("error-get-node-id-%#v", err)
+		if nidErr, ok := err.(*nodeIDError); ok {
+			return *csi_utils.ErrGetNodeID(nidErr.code, nidErr.msg), nil
+		}
 		return csi.GetNodeIDResponse{}, err
 	}
 	return csi.GetNodeIDResponse{
 		Reply: &csi.GetNodeIDResponse_Result_{
 			Result: &csi.GetNodeIDResponse_Result{
-				NodeId: &csi.NodeID{
-					Values: map[string]string{
-						"instanceID": hostname,
-					},
-				},
+				NodeId: nodeID,
 			},
 		},
 	}, nil
 }
 
-func (c *Controller) ProbeNode(request csi.ProbeNodeRequest) (csi.ProbeNodeResponse, error) {
+//ProbeNode checks that the node can serve the enabled backends
+func (c *Controller) ProbeNode(ctx context.Context, request csi.ProbeNodeRequest) (csi.ProbeNodeResponse, error) {
+	c.logger.Printf("Entering-controller-probe-node")
+	defer c.logger.Printf("Exiting-controller-probe-node")
+	if err := c.probeNode(ctx); err != nil {
+		c.logger.Printf("error-probe-node-%#v", err)
+		if pErr, ok := err.(*probeError); ok {
+			return *csi_utils.ErrProbeNode(pErr.code, pErr.msg), nil
+		}
+		return csi.ProbeNodeResponse{}, err
+	}
 	return csi.ProbeNodeResponse{
 		Reply: &csi.ProbeNodeResponse_Result_{
 			Result: &csi.ProbeNodeResponse_Result{},
@@ -309,8 +1013,15 @@ func (c *Controller) ProbeNode(request csi.ProbeNodeRequest) (csi.ProbeNodeRespo
 	}, nil
 }
 
-func (c *Controller) GetNodeCapabilities(request csi.NodeGetCapabilitiesRequest) (csi.NodeGetCapabilitiesResponse, error) {
-	return csi.NodeGetCapabilitiesResponse{}, nil
+//GetNodeCapabilities returns the optional node rpcs, the node service implements none of them
+func (c *Controller) GetNodeCapabilities(ctx context.Context, request csi.NodeGetCapabilitiesRequest) (csi.NodeGetCapabilitiesResponse, error) {
+	return csi.NodeGetCapabilitiesResponse{
+		Reply: &csi.NodeGetCapabilitiesResponse_Result_{
+			Result: &csi.NodeGetCapabilitiesResponse_Result{
+				Capabilities: []*csi.NodeServiceCapability{},
+			},
+		},
+	}, nil
 }
 
 //id, ok := req.GetVolumeId().GetValues()["id"]
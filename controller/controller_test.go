@@ -17,7 +17,16 @@
 package controller_test
 
 import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
 
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
@@ -25,6 +34,9 @@ import (
 	"fmt"
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	ctl "github.com/midoblgsm/ubiquity-csi/controller"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"github.com/midoblgsm/ubiquity/fakes"
 	"github.com/midoblgsm/ubiquity/resources"
 )
@@ -35,28 +47,1762 @@ var _ = Describe("Controller", func() {
 		fakeClient     *fakes.FakeStorageClient
 		controller     *ctl.Controller
 		fakeExec       *fakes.FakeExecutor
-		ubiquityConfig resources.UbiquityPluginConfig
+		ubiquityConfig ctl.Config
 	)
 	BeforeEach(func() {
 		fakeExec = new(fakes.FakeExecutor)
-		ubiquityConfig = resources.UbiquityPluginConfig{}
+		ubiquityConfig = ctl.Config{}
 		fakeClient = new(fakes.FakeStorageClient)
-		controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec)
+		controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
 		os.MkdirAll("/tmp/test/mnt2", 0777)
 	})
 
 	Context(".CreateVolume", func() {
+		var request csi.CreateVolumeRequest
+		BeforeEach(func() {
+			fakeClient.GetVolumeReturns(resources.GetVolumeResponse{Error: fmt.Errorf("Volume not found")})
+			request = csi.CreateVolumeRequest{Name: "testVolume", Version: &csi.Version{}, CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024, LimitBytes: 1024 * 1024}, Parameters: map[string]string{"backend": "localhost"}}
+		})
 		It("Should fail when ubiquity client returns an error", func() {
 			params := make(map[string]string)
-			params["backend"] = "test_backend"
+			params["backend"] = "localhost"
 			createResponse := resources.CreateVolumeResponse{Volume: resources.Volume{}, Error: fmt.Errorf("error occurred")}
 			fakeClient.CreateVolumeReturns(createResponse)
 
-			request := csi.CreateVolumeRequest{Name: "testVolume", Version: &csi.Version{}, CapacityRange: &csi.CapacityRange{RequiredBytes: 100, LimitBytes: 100}, Parameters: params}
+			request := csi.CreateVolumeRequest{Name: "testVolume", Version: &csi.Version{}, CapacityRange: &csi.CapacityRange{RequiredBytes: 1024 * 1024, LimitBytes: 1024 * 1024}, Parameters: params}
 
-			createVolumeResponse, err := controller.CreateVolume(request)
+			createVolumeResponse, err := controller.CreateVolume(context.Background(), request)
 			Expect(err).To(HaveOccurred())
 			Expect(createVolumeResponse).ToNot(BeNil())
 		})
+		It("Should create the volume when it does not exist yet", func() {
+			fakeClient.CreateVolumeReturns(resources.CreateVolumeResponse{Volume: resources.Volume{Name: "testVolume", Backend: "localhost"}})
+			createVolumeResponse, err := controller.CreateVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeClient.CreateVolumeCallCount()).To(Equal(1))
+			Expect(createVolumeResponse.GetResult().GetVolumeInfo().GetHandle().GetId()).To(Equal("testVolume"))
+		})
+		It("Should return the existing volume when it is compatible with the request", func() {
+			fakeClient.GetVolumeReturns(resources.GetVolumeResponse{Volume: resources.Volume{Name: "testVolume", Backend: "localhost", CapacityBytes: 1024 * 1024}})
+			createVolumeResponse, err := controller.CreateVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeClient.CreateVolumeCallCount()).To(Equal(0))
+			Expect(createVolumeResponse.GetResult().GetVolumeInfo().GetHandle().GetId()).To(Equal("testVolume"))
+			Expect(createVolumeResponse.GetResult().GetVolumeInfo().GetCapacityBytes()).To(Equal(uint64(1024 * 1024)))
+		})
+		It("Should fail with VOLUME_ALREADY_EXISTS when the existing volume is on another backend", func() {
+			fakeClient.GetVolumeReturns(resources.GetVolumeResponse{Volume: resources.Volume{Name: "testVolume", Backend: "scbe", CapacityBytes: 1024 * 1024}})
+			createVolumeResponse, err := controller.CreateVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeClient.CreateVolumeCallCount()).To(Equal(0))
+			Expect(createVolumeResponse.GetError().GetCreateVolumeError().GetErrorCode()).To(Equal(csi.Error_CreateVolumeError_VOLUME_ALREADY_EXISTS))
+		})
+		It("Should fail with VOLUME_ALREADY_EXISTS when the existing volume capacity is out of range", func() {
+			fakeClient.GetVolumeReturns(resources.GetVolumeResponse{Volume: resources.Volume{Name: "testVolume", Backend: "localhost", CapacityBytes: 512 * 1024}})
+			createVolumeResponse, err := controller.CreateVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeClient.CreateVolumeCallCount()).To(Equal(0))
+			Expect(createVolumeResponse.GetError().GetCreateVolumeError().GetErrorCode()).To(Equal(csi.Error_CreateVolumeError_VOLUME_ALREADY_EXISTS))
+		})
+		It("Should request the required bytes rounded up to the backend allocation unit", func() {
+			request.CapacityRange = &csi.CapacityRange{RequiredBytes: 1000, LimitBytes: 10 * 1024 * 1024}
+			fakeClient.CreateVolumeReturns(resources.CreateVolumeResponse{Volume: resources.Volume{Name: "testVolume", Backend: "localhost"}})
+			createVolumeResponse, err := controller.CreateVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeClient.CreateVolumeArgsForCall(0).Metadata["size"]).To(Equal("1048576"))
+			Expect(fakeClient.CreateVolumeArgsForCall(0).Metadata["quota"]).To(Equal("1048576"))
+			Expect(createVolumeResponse.GetResult().GetVolumeInfo().GetCapacityBytes()).To(Equal(uint64(1048576)))
+		})
+		It("Should report the capacity provisioned by the backend", func() {
+			request.CapacityRange = &csi.CapacityRange{RequiredBytes: 1024 * 1024}
+			fakeClient.CreateVolumeReturns(resources.CreateVolumeResponse{Volume: resources.Volume{Name: "testVolume", Backend: "localhost", CapacityBytes: 2 * 1024 * 1024}})
+			createVolumeResponse, err := controller.CreateVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(createVolumeResponse.GetResult().GetVolumeInfo().GetCapacityBytes()).To(Equal(uint64(2 * 1024 * 1024)))
+		})
+		It("Should use the configured default size when no capacity range is given", func() {
+			ubiquityConfig.CsiConfig.DefaultVolumeSize = 5 * 1024 * 1024
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			request.CapacityRange = nil
+			fakeClient.CreateVolumeReturns(resources.CreateVolumeResponse{Volume: resources.Volume{Name: "testVolume", Backend: "localhost"}})
+			createVolumeResponse, err := controller.CreateVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeClient.CreateVolumeArgsForCall(0).Metadata["size"]).To(Equal("5242880"))
+			Expect(createVolumeResponse.GetResult().GetVolumeInfo().GetCapacityBytes()).To(Equal(uint64(5242880)))
+		})
+		It("Should fail with UNSUPPORTED_CAPACITY_RANGE when required bytes exceed limit bytes", func() {
+			request.CapacityRange = &csi.CapacityRange{RequiredBytes: 200, LimitBytes: 100}
+			createVolumeResponse, err := controller.CreateVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeClient.CreateVolumeCallCount()).To(Equal(0))
+			Expect(createVolumeResponse.GetError().GetCreateVolumeError().GetErrorCode()).To(Equal(csi.Error_CreateVolumeError_UNSUPPORTED_CAPACITY_RANGE))
+		})
+		It("Should fail with UNSUPPORTED_CAPACITY_RANGE when no allocation unit fits in the range", func() {
+			request.CapacityRange = &csi.CapacityRange{RequiredBytes: 100, LimitBytes: 200}
+			request.Parameters["backend"] = "scbe"
+			createVolumeResponse, err := controller.CreateVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeClient.CreateVolumeCallCount()).To(Equal(0))
+			Expect(createVolumeResponse.GetError().GetCreateVolumeError().GetErrorCode()).To(Equal(csi.Error_CreateVolumeError_UNSUPPORTED_CAPACITY_RANGE))
+		})
+		It("Should fail with INVALID_PARAMETER for a parameter unknown to the backend", func() {
+			request.Parameters = map[string]string{"backend": "spectrum-scale", "filesytem": "gold"}
+			createVolumeResponse, err := controller.CreateVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeClient.GetVolumeCallCount()).To(Equal(0))
+			Expect(fakeClient.CreateVolumeCallCount()).To(Equal(0))
+			Expect(createVolumeResponse.GetError().GetCreateVolumeError().GetErrorCode()).To(Equal(csi.Error_CreateVolumeError_INVALID_PARAMETER))
+		})
+		It("Should fail with INVALID_PARAMETER for a value outside of the parameter enum", func() {
+			request.Parameters = map[string]string{"backend": "scbe", "fstype": "btrfs"}
+			createVolumeResponse, err := controller.CreateVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(createVolumeResponse.GetError().GetCreateVolumeError().GetErrorCode()).To(Equal(csi.Error_CreateVolumeError_INVALID_PARAMETER))
+		})
+		It("Should fail with INVALID_PARAMETER for an unsupported backend", func() {
+			request.Parameters = map[string]string{"backend": "test_backend"}
+			createVolumeResponse, err := controller.CreateVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(createVolumeResponse.GetError().GetCreateVolumeError().GetErrorCode()).To(Equal(csi.Error_CreateVolumeError_INVALID_PARAMETER))
+		})
+		It("Should fill the defaults of the backend parameters", func() {
+			request.Parameters = map[string]string{"backend": "spectrum-scale", "uid": "1000"}
+			fakeClient.CreateVolumeReturns(resources.CreateVolumeResponse{Volume: resources.Volume{Name: "testVolume", Backend: "spectrum-scale"}})
+			_, err := controller.CreateVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeClient.CreateVolumeArgsForCall(0).Metadata["type"]).To(Equal("fileset"))
+			Expect(fakeClient.CreateVolumeArgsForCall(0).Metadata["uid"]).To(Equal("1000"))
+		})
+		It("Should fail when the lookup of the existing volume fails", func() {
+			fakeClient.GetVolumeReturns(resources.GetVolumeResponse{Error: fmt.Errorf("connection refused")})
+			_, err := controller.CreateVolume(context.Background(), request)
+			Expect(err).To(HaveOccurred())
+			Expect(fakeClient.CreateVolumeCallCount()).To(Equal(0))
+		})
+	})
+
+	Context(".ValidateCapabilities", func() {
+		var request csi.ValidateVolumeCapabilitiesRequest
+		BeforeEach(func() {
+			request = csi.ValidateVolumeCapabilitiesRequest{
+				Version:    &csi.Version{},
+				VolumeInfo: &csi.VolumeInfo{Handle: &csi.VolumeHandle{Id: "testVolume"}},
+				VolumeCapabilities: []*csi.VolumeCapability{
+					{
+						AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+						AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER},
+					},
+				},
+			}
+			fakeClient.GetVolumeReturns(resources.GetVolumeResponse{Volume: resources.Volume{Name: "testVolume", Backend: "localhost"}})
+		})
+		It("Should fail with VOLUME_DOES_NOT_EXIST when the volume is missing", func() {
+			fakeClient.GetVolumeReturns(resources.GetVolumeResponse{Error: fmt.Errorf("Volume not found")})
+			validateResponse, err := controller.ValidateCapabilities(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(validateResponse.GetError().GetValidateVolumeCapabilitiesError().GetErrorCode()).To(Equal(csi.Error_ValidateVolumeCapabilitiesError_VOLUME_DOES_NOT_EXIST))
+		})
+		It("Should support a single node mount on the localhost backend", func() {
+			validateResponse, err := controller.ValidateCapabilities(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(validateResponse.GetResult().GetSupported()).To(BeTrue())
+		})
+		It("Should not support mount flags that are not allowed", func() {
+			request.VolumeCapabilities[0].GetMount().MountFlags = []string{"dev"}
+			validateResponse, err := controller.ValidateCapabilities(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(validateResponse.GetResult().GetSupported()).To(BeFalse())
+		})
+		It("Should not support a multi node access mode on the localhost backend", func() {
+			request.VolumeCapabilities[0].AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+			validateResponse, err := controller.ValidateCapabilities(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(validateResponse.GetResult().GetSupported()).To(BeFalse())
+			Expect(validateResponse.GetResult().GetMessage()).To(ContainSubstring("access mode"))
+		})
+		It("Should support a multi node access mode on the spectrum-scale backend", func() {
+			fakeClient.GetVolumeReturns(resources.GetVolumeResponse{Volume: resources.Volume{Name: "testVolume", Backend: "spectrum-scale"}})
+			request.VolumeCapabilities[0].AccessMode.Mode = csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER
+			validateResponse, err := controller.ValidateCapabilities(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(validateResponse.GetResult().GetSupported()).To(BeTrue())
+		})
+		It("Should support the fs types of the scbe backend only", func() {
+			fakeClient.GetVolumeReturns(resources.GetVolumeResponse{Volume: resources.Volume{Name: "testVolume", Backend: "scbe"}})
+			request.VolumeCapabilities[0].AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "xfs"}}
+			validateResponse, err := controller.ValidateCapabilities(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(validateResponse.GetResult().GetSupported()).To(BeTrue())
+			request.VolumeCapabilities[0].AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: "btrfs"}}
+			validateResponse, err = controller.ValidateCapabilities(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(validateResponse.GetResult().GetSupported()).To(BeFalse())
+		})
+	})
+
+	Context(".GetCapacity", func() {
+		var request csi.GetCapacityRequest
+		BeforeEach(func() {
+			ubiquityConfig.Backends = []string{"localhost", "scbe"}
+			ubiquityConfig.LocalHostConfig.LocalhostPath = "/tmp/test/mnt2"
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			request = csi.GetCapacityRequest{Version: &csi.Version{}, Parameters: map[string]string{"backend": "localhost"}}
+		})
+		It("Should report the space available on the localhost path", func() {
+			getCapacityResponse, err := controller.GetCapacity(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getCapacityResponse.GetResult().GetAvailableCapacity()).To(BeNumerically(">", 0))
+		})
+		It("Should default to the first configured backend", func() {
+			request.Parameters = nil
+			getCapacityResponse, err := controller.GetCapacity(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getCapacityResponse.GetResult().GetAvailableCapacity()).To(BeNumerically(">", 0))
+		})
+		It("Should serve the capacity from the cache", func() {
+			os.MkdirAll("/tmp/test/capacity", 0777)
+			ubiquityConfig.LocalHostConfig.LocalhostPath = "/tmp/test/capacity"
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			first, err := controller.GetCapacity(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(first.GetResult()).ToNot(BeNil())
+			os.RemoveAll("/tmp/test/capacity")
+			second, err := controller.GetCapacity(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(second.GetResult()).ToNot(BeNil())
+		})
+		It("Should fail when the localhost path does not exist", func() {
+			ubiquityConfig.LocalHostConfig.LocalhostPath = "/tmp/test/not-there"
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			getCapacityResponse, err := controller.GetCapacity(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getCapacityResponse.GetError().GetGeneralError()).ToNot(BeNil())
+		})
+		It("Should fail when the backend is not enabled", func() {
+			request.Parameters["backend"] = "spectrum-scale"
+			getCapacityResponse, err := controller.GetCapacity(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getCapacityResponse.GetError().GetGeneralError()).ToNot(BeNil())
+		})
+		It("Should fail for scbe which cannot report its capacity", func() {
+			request.Parameters["backend"] = "scbe"
+			getCapacityResponse, err := controller.GetCapacity(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getCapacityResponse.GetResult()).To(BeNil())
+			Expect(getCapacityResponse.GetError().GetGeneralError().GetErrorDescription()).To(ContainSubstring("unknown"))
+		})
+		It("Should report the space available on the file system of the spectrum-scale volumes", func() {
+			ubiquityConfig.Backends = []string{"spectrum-scale"}
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			request.Parameters["backend"] = "spectrum-scale"
+			fakeClient.ListVolumesReturns(resources.ListVolumesResponse{Volumes: []resources.Volume{{Name: "localVolume", Backend: "localhost", Mountpoint: "/tmp/test/not-there"}, {Name: "gpfsVolume", Backend: "spectrum-scale"}}})
+			fakeClient.GetVolumeReturns(resources.GetVolumeResponse{Volume: resources.Volume{Name: "gpfsVolume", Backend: "spectrum-scale", Mountpoint: "/tmp/test/mnt2"}})
+			getCapacityResponse, err := controller.GetCapacity(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getCapacityResponse.GetResult().GetAvailableCapacity()).To(BeNumerically(">", 0))
+			Expect(fakeClient.GetVolumeArgsForCall(0).Name).To(Equal("gpfsVolume"))
+		})
+		It("Should report no capacity for spectrum-scale until one of its volumes is mounted on the node", func() {
+			ubiquityConfig.Backends = []string{"spectrum-scale"}
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			request.Parameters["backend"] = "spectrum-scale"
+			fakeClient.ListVolumesReturns(resources.ListVolumesResponse{Volumes: []resources.Volume{{Name: "gpfsVolume", Backend: "spectrum-scale", Mountpoint: "/tmp/test/not-there"}}})
+			getCapacityResponse, err := controller.GetCapacity(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getCapacityResponse.GetResult()).To(BeNil())
+			Expect(getCapacityResponse.GetError().GetGeneralError()).ToNot(BeNil())
+
+			// the unknown capacity is not cached
+			fakeClient.ListVolumesReturns(resources.ListVolumesResponse{Volumes: []resources.Volume{{Name: "gpfsVolume", Backend: "spectrum-scale", Mountpoint: "/tmp/test/mnt2"}}})
+			getCapacityResponse, err = controller.GetCapacity(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getCapacityResponse.GetResult().GetAvailableCapacity()).To(BeNumerically(">", 0))
+		})
+		It("Should not hold the cache while ubiquity is queried for another backend", func() {
+			ubiquityConfig.Backends = []string{"localhost", "spectrum-scale"}
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			listing, release := make(chan struct{}), make(chan struct{})
+			fakeClient.ListVolumesStub = func(resources.ListVolumesRequest) resources.ListVolumesResponse {
+				close(listing)
+				<-release
+				return resources.ListVolumesResponse{Volumes: []resources.Volume{{Name: "gpfsVolume", Backend: "spectrum-scale", Mountpoint: "/tmp/test/mnt2"}}}
+			}
+			done := make(chan csi.GetCapacityResponse)
+			go func() {
+				defer GinkgoRecover()
+				response, err := controller.GetCapacity(context.Background(), csi.GetCapacityRequest{Version: &csi.Version{}, Parameters: map[string]string{"backend": "spectrum-scale"}})
+				Expect(err).ToNot(HaveOccurred())
+				done <- response
+			}()
+			<-listing
+			getCapacityResponse, err := controller.GetCapacity(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getCapacityResponse.GetResult().GetAvailableCapacity()).To(BeNumerically(">", 0))
+			close(release)
+			getCapacityResponse = <-done
+			Expect(getCapacityResponse.GetResult().GetAvailableCapacity()).To(BeNumerically(">", 0))
+		})
+		It("Should return the context error when the request is cancelled while ubiquity is queried", func() {
+			ubiquityConfig.Backends = []string{"spectrum-scale"}
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			request.Parameters["backend"] = "spectrum-scale"
+			cancelled, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := controller.GetCapacity(cancelled, request)
+			Expect(err).To(Equal(context.Canceled))
+			Expect(controller.InterruptedOperations()).To(BeEmpty())
+		})
+		It("Should fail when ubiquity cannot list the spectrum-scale volumes", func() {
+			ubiquityConfig.Backends = []string{"spectrum-scale"}
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			request.Parameters["backend"] = "spectrum-scale"
+			fakeClient.ListVolumesReturns(resources.ListVolumesResponse{Error: errors.New("ubiquity is down")})
+			getCapacityResponse, err := controller.GetCapacity(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(getCapacityResponse.GetError().GetGeneralError()).ToNot(BeNil())
+		})
+	})
+
+	Context(".ListVolumes", func() {
+		var request csi.ListVolumesRequest
+		listedNames := func(response csi.ListVolumesResponse) []string {
+			names := []string{}
+			for _, entry := range response.GetResult().GetEntries() {
+				names = append(names, entry.GetVolumeInfo().GetHandle().GetId())
+			}
+			return names
+		}
+		BeforeEach(func() {
+			request = csi.ListVolumesRequest{Version: &csi.Version{}}
+			fakeClient.ListVolumesReturns(resources.ListVolumesResponse{Volumes: []resources.Volume{{Name: "vol3"}, {Name: "vol1"}, {Name: "vol2"}}})
+		})
+		It("Should return all the volumes in name order when max entries is not set", func() {
+			listVolumesResponse, err := controller.ListVolumes(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(listedNames(listVolumesResponse)).To(Equal([]string{"vol1", "vol2", "vol3"}))
+			Expect(listVolumesResponse.GetResult().GetNextToken()).To(BeEmpty())
+		})
+		It("Should page the volumes with max entries and starting token", func() {
+			request.MaxEntries = 2
+			listVolumesResponse, err := controller.ListVolumes(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(listedNames(listVolumesResponse)).To(Equal([]string{"vol1", "vol2"}))
+			Expect(listVolumesResponse.GetResult().GetNextToken()).ToNot(BeEmpty())
+
+			request.StartingToken = listVolumesResponse.GetResult().GetNextToken()
+			listVolumesResponse, err = controller.ListVolumes(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(listedNames(listVolumesResponse)).To(Equal([]string{"vol3"}))
+			Expect(listVolumesResponse.GetResult().GetNextToken()).To(BeEmpty())
+		})
+		It("Should keep paging consistent when volumes change between pages", func() {
+			request.MaxEntries = 2
+			listVolumesResponse, err := controller.ListVolumes(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			fakeClient.ListVolumesReturns(resources.ListVolumesResponse{Volumes: []resources.Volume{{Name: "vol0"}, {Name: "vol3"}, {Name: "vol4"}}})
+
+			request.StartingToken = listVolumesResponse.GetResult().GetNextToken()
+			listVolumesResponse, err = controller.ListVolumes(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(listedNames(listVolumesResponse)).To(Equal([]string{"vol3", "vol4"}))
+			Expect(listVolumesResponse.GetResult().GetNextToken()).To(BeEmpty())
+		})
+		It("Should fail with a general error when the starting token is invalid", func() {
+			request.StartingToken = "not-a-token"
+			listVolumesResponse, err := controller.ListVolumes(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(listVolumesResponse.GetError().GetGeneralError().GetErrorCode()).To(Equal(csi.Error_GeneralError_UNDEFINED))
+		})
+	})
+
+	Context(".Attach", func() {
+		var request csi.ControllerPublishVolumeRequest
+		BeforeEach(func() {
+			request = csi.ControllerPublishVolumeRequest{
+				Version:      &csi.Version{},
+				VolumeHandle: &csi.VolumeHandle{Id: "testVolume"},
+				NodeId:       &csi.NodeID{Values: map[string]string{"hostname": "node1"}},
+			}
+			fakeClient.AttachReturns(resources.AttachResponse{Mountpoint: "/tmp/test/mnt2"})
+		})
+		It("Should publish the mountpoint returned by ubiquity", func() {
+			attachResponse, err := controller.Attach(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(attachResponse.GetResult().GetPublishVolumeInfo().GetValues()["mountpoint"]).To(Equal("/tmp/test/mnt2"))
+			Expect(attachResponse.GetResult().GetPublishVolumeInfo().GetValues()["readonly"]).To(Equal("false"))
+			Expect(fakeClient.AttachArgsForCall(0).Host).To(Equal("node1"))
+		})
+		It("Should publish read-only volumes as read-only", func() {
+			request.Readonly = true
+			attachResponse, err := controller.Attach(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(attachResponse.GetResult().GetPublishVolumeInfo().GetValues()["readonly"]).To(Equal("true"))
+		})
+		It("Should fail with OPERATION_PENDING_FOR_VOLUME while the volume is busy and not block other volumes", func() {
+			started, release := make(chan bool, 2), make(chan bool)
+			fakeClient.AttachStub = func(attachRequest resources.AttachRequest) resources.AttachResponse {
+				if attachRequest.Name == "testVolume" {
+					started <- true
+					<-release
+				}
+				return resources.AttachResponse{Mountpoint: "/tmp/test/mnt2"}
+			}
+			done := make(chan csi.ControllerPublishVolumeResponse)
+			go func() {
+				defer GinkgoRecover()
+				attachResponse, err := controller.Attach(context.Background(), request)
+				Expect(err).ToNot(HaveOccurred())
+				done <- attachResponse
+			}()
+			<-started
+
+			attachResponse, err := controller.Attach(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(attachResponse.GetError().GetControllerPublishVolumeError().GetErrorCode()).To(Equal(csi.Error_ControllerPublishVolumeError_OPERATION_PENDING_FOR_VOLUME))
+			otherRequest := request
+			otherRequest.VolumeHandle = &csi.VolumeHandle{Id: "otherVolume"}
+			attachResponse, err = controller.Attach(context.Background(), otherRequest)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(attachResponse.GetResult()).ToNot(BeNil())
+
+			close(release)
+			attachResponse = <-done
+			Expect(attachResponse.GetResult()).ToNot(BeNil())
+			attachResponse, err = controller.Attach(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(attachResponse.GetResult()).ToNot(BeNil())
+		})
+		It("Should give up when the context times out and keep the volume busy until ubiquity answers", func() {
+			release := make(chan bool)
+			fakeClient.AttachStub = func(attachRequest resources.AttachRequest) resources.AttachResponse {
+				<-release
+				return resources.AttachResponse{Mountpoint: "/tmp/test/mnt2"}
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+			defer cancel()
+			_, err := controller.Attach(ctx, request)
+			Expect(err).To(Equal(context.DeadlineExceeded))
+
+			attachResponse, err := controller.Attach(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(attachResponse.GetError().GetControllerPublishVolumeError().GetErrorCode()).To(Equal(csi.Error_ControllerPublishVolumeError_OPERATION_PENDING_FOR_VOLUME))
+			Expect(controller.WaitForOperations(10 * time.Millisecond)).To(BeFalse())
+
+			close(release)
+			Expect(controller.WaitForOperations(time.Second)).To(BeTrue())
+			Eventually(func() *csi.ControllerPublishVolumeResponse_Result {
+				attachResponse, _ := controller.Attach(context.Background(), request)
+				return attachResponse.GetResult()
+			}).ShouldNot(BeNil())
+		})
+		It("Should fail with INVALID_NODE_ID when the node id is missing", func() {
+			request.NodeId = nil
+			attachResponse, err := controller.Attach(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(attachResponse.GetError().GetControllerPublishVolumeError().GetErrorCode()).To(Equal(csi.Error_ControllerPublishVolumeError_INVALID_NODE_ID))
+			Expect(fakeClient.AttachCallCount()).To(Equal(0))
+		})
+		It("Should map ubiquity attach errors to publish error codes", func() {
+			expectedCodes := map[string]csi.Error_ControllerPublishVolumeError_ControllerPublishVolumeErrorCode{
+				"Volume not found":                          csi.Error_ControllerPublishVolumeError_VOLUME_DOES_NOT_EXIST,
+				"host node1 not found":                      csi.Error_ControllerPublishVolumeError_NODE_DOES_NOT_EXIST,
+				"volume is already attached to node2":       csi.Error_ControllerPublishVolumeError_VOLUME_ALREADY_PUBLISHED,
+				"reached the maximum number of attachments": csi.Error_ControllerPublishVolumeError_MAX_ATTACHED_NODES,
+			}
+			for message, code := range expectedCodes {
+				fakeClient.AttachReturns(resources.AttachResponse{Error: errors.New(message)})
+				attachResponse, err := controller.Attach(context.Background(), request)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(attachResponse.GetError().GetControllerPublishVolumeError().GetErrorCode()).To(Equal(code))
+			}
+		})
+		It("Should resolve the host from the short fqdn", func() {
+			request.NodeId = &csi.NodeID{Values: map[string]string{"fqdn": "node1.example.com"}}
+			_, err := controller.Attach(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeClient.AttachArgsForCall(0).Host).To(Equal("node1"))
+		})
+		It("Should resolve the host of an iqn from the configured hosts", func() {
+			ubiquityConfig.CsiConfig.NodeIdentity.Hosts = map[string]string{"iqn.1994-05.com.redhat:node1": "node1"}
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			request.NodeId = &csi.NodeID{Values: map[string]string{"iqn": "iqn.1994-05.com.redhat:node1"}}
+			_, err := controller.Attach(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeClient.AttachArgsForCall(0).Host).To(Equal("node1"))
+		})
+		It("Should fail with INVALID_NODE_ID when the node id cannot be resolved", func() {
+			request.NodeId = &csi.NodeID{Values: map[string]string{"wwpns": "10000090fa000001"}}
+			attachResponse, err := controller.Attach(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(attachResponse.GetError().GetControllerPublishVolumeError().GetErrorCode()).To(Equal(csi.Error_ControllerPublishVolumeError_INVALID_NODE_ID))
+			Expect(fakeClient.AttachCallCount()).To(Equal(0))
+		})
+		It("Should fail with UNSUPPORTED_VOLUME_TYPE for block access on a file system backend", func() {
+			request.VolumeHandle.Metadata = map[string]string{"backend": "localhost"}
+			request.VolumeCapability = &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+			attachResponse, err := controller.Attach(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(attachResponse.GetError().GetControllerPublishVolumeError().GetErrorCode()).To(Equal(csi.Error_ControllerPublishVolumeError_UNSUPPORTED_VOLUME_TYPE))
+			Expect(fakeClient.AttachCallCount()).To(Equal(0))
+		})
+		It("Should fail when ubiquity client returns an error", func() {
+			fakeClient.AttachReturns(resources.AttachResponse{Error: fmt.Errorf("error occurred")})
+			_, err := controller.Attach(context.Background(), request)
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context(".Detach", func() {
+		It("Should fail with INVALID_VOLUME_ID when the volume handle is missing", func() {
+			detachResponse, err := controller.Detach(context.Background(), csi.ControllerUnpublishVolumeRequest{Version: &csi.Version{}, NodeId: &csi.NodeID{Values: map[string]string{"hostname": "node1"}}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(detachResponse.GetError().GetControllerUnpublishVolumeError().GetErrorCode()).To(Equal(csi.Error_ControllerUnpublishVolumeError_INVALID_VOLUME_ID))
+			Expect(fakeClient.DetachCallCount()).To(Equal(0))
+		})
+		It("Should succeed when the volume is not attached to the node anymore", func() {
+			fakeClient.DetachReturns(resources.DetachResponse{Error: errors.New("volume testVolume is not attached to host node1")})
+			detachResponse, err := controller.Detach(context.Background(), csi.ControllerUnpublishVolumeRequest{Version: &csi.Version{}, VolumeHandle: &csi.VolumeHandle{Id: "testVolume"}, NodeId: &csi.NodeID{Values: map[string]string{"hostname": "node1"}}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(detachResponse.GetError()).To(BeNil())
+		})
+		It("Should fail with VOLUME_NOT_ATTACHED_TO_SPECIFIED_NODE when the volume is attached to another node", func() {
+			fakeClient.DetachReturns(resources.DetachResponse{Error: errors.New("volume testVolume is attached to another host node2")})
+			detachResponse, err := controller.Detach(context.Background(), csi.ControllerUnpublishVolumeRequest{Version: &csi.Version{}, VolumeHandle: &csi.VolumeHandle{Id: "testVolume"}, NodeId: &csi.NodeID{Values: map[string]string{"hostname": "node1"}}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(detachResponse.GetError().GetControllerUnpublishVolumeError().GetErrorCode()).To(Equal(csi.Error_ControllerUnpublishVolumeError_VOLUME_NOT_ATTACHED_TO_SPECIFIED_NODE))
+		})
+	})
+
+	Context(".NewController", func() {
+		It("Should refuse a configuration without a directory for the publish-state journal", func() {
+			_, err := ctl.NewController(testLogger, "ubiquity-csi", "http://127.0.0.1:9999/ubiquity_storage", ctl.Config{})
+			Expect(err).To(HaveOccurred())
+			Expect(err.Error()).To(ContainSubstring("statePath"))
+		})
+	})
+
+	Context(".InterruptedOperations", func() {
+		var (
+			cancelled context.Context
+			attach    csi.ControllerPublishVolumeRequest
+			detach    csi.ControllerUnpublishVolumeRequest
+		)
+		BeforeEach(func() {
+			var cancel context.CancelFunc
+			cancelled, cancel = context.WithCancel(context.Background())
+			cancel()
+			attach = csi.ControllerPublishVolumeRequest{Version: &csi.Version{}, VolumeHandle: &csi.VolumeHandle{Id: "testVolume"}, NodeId: &csi.NodeID{Values: map[string]string{"hostname": "node1"}}}
+			detach = csi.ControllerUnpublishVolumeRequest{Version: &csi.Version{}, VolumeHandle: &csi.VolumeHandle{Id: "testVolume"}, NodeId: &csi.NodeID{Values: map[string]string{"hostname": "node1"}}}
+			fakeClient.AttachReturns(resources.AttachResponse{Mountpoint: "/tmp/test/mnt2"})
+		})
+		It("Should record an interrupted operation until its retry on the volume", func() {
+			_, err := controller.Attach(cancelled, attach)
+			Expect(err).To(Equal(context.Canceled))
+			_, err = controller.Detach(cancelled, detach)
+			Expect(err).To(Equal(context.Canceled))
+			Expect(controller.InterruptedOperations()).To(Equal([]string{"attach/testVolume", "detach/testVolume"}))
+
+			_, err = controller.Attach(context.Background(), attach)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(controller.InterruptedOperations()).To(Equal([]string{"detach/testVolume"}))
+			_, err = controller.Detach(context.Background(), detach)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(controller.InterruptedOperations()).To(BeEmpty())
+		})
+		It("Should not record the operations that have nothing to resume", func() {
+			_, err := controller.ListVolumes(cancelled, csi.ListVolumesRequest{Version: &csi.Version{}})
+			Expect(err).To(Equal(context.Canceled))
+			_, err = controller.ValidateCapabilities(cancelled, csi.ValidateVolumeCapabilitiesRequest{Version: &csi.Version{}, VolumeInfo: &csi.VolumeInfo{Handle: &csi.VolumeHandle{Id: "testVolume"}}})
+			Expect(err).To(Equal(context.Canceled))
+			Expect(controller.InterruptedOperations()).To(BeEmpty())
+		})
+		It("Should forget the interrupted operations of a deleted volume", func() {
+			_, err := controller.Attach(cancelled, attach)
+			Expect(err).To(Equal(context.Canceled))
+			_, err = controller.DeleteVolume(cancelled, csi.DeleteVolumeRequest{Version: &csi.Version{}, VolumeHandle: &csi.VolumeHandle{Id: "testVolume"}})
+			Expect(err).To(Equal(context.Canceled))
+			Expect(controller.InterruptedOperations()).To(Equal([]string{"attach/testVolume", "delete/testVolume"}))
+
+			deleteResponse, err := controller.DeleteVolume(context.Background(), csi.DeleteVolumeRequest{Version: &csi.Version{}, VolumeHandle: &csi.VolumeHandle{Id: "testVolume"}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deleteResponse.GetResult()).ToNot(BeNil())
+			Expect(controller.InterruptedOperations()).To(BeEmpty())
+		})
+		It("Should list the interrupted operations on the admin endpoint", func() {
+			_, err := controller.Attach(cancelled, attach)
+			Expect(err).To(Equal(context.Canceled))
+			recorder := httptest.NewRecorder()
+			controller.AdminHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/interrupted", nil))
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(Equal(`["attach/testVolume"]` + "\n"))
+		})
+	})
+
+	Context(".GetPluginInfos", func() {
+		It("Should publish the parameter schemas of the enabled backends", func() {
+			ubiquityConfig.Backends = []string{"scbe"}
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			pluginInfoResponse, err := controller.GetPluginInfos(context.Background(), csi.GetPluginInfoRequest{Version: &csi.Version{}})
+			Expect(err).ToNot(HaveOccurred())
+			manifest := pluginInfoResponse.GetResult().GetManifest()
+			Expect(manifest["backends"]).To(Equal("scbe"))
+			Expect(manifest["parameters.scbe"]).To(ContainSubstring(`"name":"fstype"`))
+			Expect(manifest).ToNot(HaveKey("parameters.localhost"))
+		})
+	})
+
+	Context(".ErrorReplies", func() {
+		It("Should translate ubiquity errors into typed csi errors", func() {
+			deleteResponse, err := ctl.DeleteVolumeErrorReply(errors.New("Volume not found"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deleteResponse.GetError().GetDeleteVolumeError().GetErrorCode()).To(Equal(csi.Error_DeleteVolumeError_VOLUME_DOES_NOT_EXIST))
+
+			detachResponse, err := ctl.ControllerUnpublishVolumeErrorReply(errors.New("volume is not attached to host node1"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(detachResponse.GetError().GetControllerUnpublishVolumeError().GetErrorCode()).To(Equal(csi.Error_ControllerUnpublishVolumeError_VOLUME_NOT_ATTACHED_TO_SPECIFIED_NODE))
+
+			listResponse, err := ctl.ListVolumesErrorReply(errors.New("error occurred"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(listResponse.GetError().GetGeneralError().GetErrorCode()).To(Equal(csi.Error_GeneralError_UNDEFINED))
+			Expect(listResponse.GetError().GetGeneralError().GetErrorDescription()).To(Equal("error occurred"))
+		})
+		It("Should return transport failures as grpc status errors", func() {
+			createResponse, err := ctl.CreateVolumeErrorReply(context.DeadlineExceeded)
+			Expect(createResponse).To(BeNil())
+			Expect(grpc.Code(err)).To(Equal(codes.DeadlineExceeded))
+		})
+	})
+
+	Context(".Mount", func() {
+		var request csi.NodePublishVolumeRequest
+		BeforeEach(func() {
+			request = csi.NodePublishVolumeRequest{
+				Version:           &csi.Version{},
+				VolumeHandle:      &csi.VolumeHandle{Id: "testVolume"},
+				PublishVolumeInfo: &csi.PublishVolumeInfo{Values: map[string]string{"mountpoint": "/tmp/test/mnt2", "readonly": "false"}},
+				TargetPath:        "/tmp/test/target",
+				VolumeCapability:  &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}},
+			}
+			mountpointInfo, err := os.Stat("/tmp/test/mnt2")
+			Expect(err).ToNot(HaveOccurred())
+			fakeExec.StatReturns(mountpointInfo, nil)
+		})
+		It("Should bind mount the mountpoint on the target path", func() {
+			mountResponse, err := controller.Mount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mountResponse.GetResult()).ToNot(BeNil())
+			Expect(fakeExec.MkdirAllCallCount()).To(Equal(2))
+			path, _ := fakeExec.MkdirAllArgsForCall(1)
+			Expect(path).To(Equal("/tmp/test/target"))
+			Expect(fakeExec.ExecuteCallCount()).To(Equal(4))
+			cmd, args := fakeExec.ExecuteArgsForCall(2)
+			Expect(cmd).To(Equal("mount"))
+			Expect(args).To(Equal([]string{"--bind", "/tmp/test/mnt2", "/var/lib/ubiquity-csi/staging/testVolume"}))
+			cmd, args = fakeExec.ExecuteArgsForCall(3)
+			Expect(cmd).To(Equal("mount"))
+			Expect(args).To(Equal([]string{"--bind", "/var/lib/ubiquity-csi/staging/testVolume", "/tmp/test/target"}))
+		})
+		It("Should refuse relative target paths and target paths with .. components", func() {
+			for _, targetPath := range []string{"tmp/test/target", "/tmp/test/../../etc"} {
+				request.TargetPath = targetPath
+				mountResponse, err := controller.Mount(context.Background(), request)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_MOUNT_ERROR))
+			}
+			Expect(fakeExec.ExecuteCallCount()).To(Equal(0))
+			Expect(fakeExec.MkdirAllCallCount()).To(Equal(0))
+		})
+		It("Should refuse target paths that are not under the target root, even through a symlink", func() {
+			targetRoot := "/var/lib/kubelet/pods"
+			links := map[string]string{targetRoot: targetRoot, filepath.Join(targetRoot, "escape"): "/etc"}
+			fakeExec.EvalSymlinksStub = func(path string) (string, error) {
+				if resolved, ok := links[path]; ok {
+					return resolved, nil
+				}
+				return "", os.ErrNotExist
+			}
+			fakeExec.IsNotExistStub = os.IsNotExist
+			fakeExec.ExecuteStub = func(cmd string, args []string) ([]byte, error) {
+				if cmd == "readlink" && args[0] != filepath.Join(targetRoot, "dangling") {
+					return nil, errors.New("exit status 1")
+				}
+				return nil, nil
+			}
+			ubiquityConfig.CsiConfig.TargetRoot = targetRoot
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			for _, targetPath := range []string{"/tmp/test/target", targetRoot, filepath.Join(targetRoot, "escape", "mount"), filepath.Join(targetRoot, "dangling", "mount")} {
+				request.TargetPath = targetPath
+				mountResponse, err := controller.Mount(context.Background(), request)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_MOUNT_ERROR))
+			}
+			for i := 0; i < fakeExec.ExecuteCallCount(); i++ {
+				cmd, _ := fakeExec.ExecuteArgsForCall(i)
+				Expect(cmd).To(Equal("readlink"))
+			}
+
+			request.TargetPath = filepath.Join(targetRoot, "pod", "volumes", "mount") + "/"
+			mountResponse, err := controller.Mount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mountResponse.GetResult()).ToNot(BeNil())
+			path, _ := fakeExec.MkdirAllArgsForCall(1)
+			Expect(path).To(Equal(filepath.Join(targetRoot, "pod", "volumes", "mount")))
+		})
+		It("Should reuse the staging mount of a volume published on another target", func() {
+			ubiquityConfig.CsiConfig.StagingPath = "/tmp/test/staging"
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			fakeExec.ExecuteReturnsOnCall(1, []byte("/tmp/test/staging/testVolume\n"), nil)
+			_, err := controller.Mount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeExec.ExecuteCallCount()).To(Equal(3))
+			cmd, args := fakeExec.ExecuteArgsForCall(2)
+			Expect(cmd).To(Equal("mount"))
+			Expect(args).To(Equal([]string{"--bind", "/tmp/test/staging/testVolume", "/tmp/test/target"}))
+		})
+		It("Should remount read-only with the mount flags", func() {
+			request.Readonly = true
+			request.VolumeCapability.GetMount().MountFlags = []string{"noexec"}
+			_, err := controller.Mount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(fakeExec.ExecuteCallCount()).To(Equal(5))
+			cmd, args := fakeExec.ExecuteArgsForCall(4)
+			Expect(cmd).To(Equal("mount"))
+			Expect(args).To(Equal([]string{"-o", "remount,bind,ro,noexec", "/tmp/test/target"}))
+		})
+		It("Should fail with UNSUPPORTED_MOUNT_FLAGS when a mount flag is not allowed", func() {
+			request.VolumeCapability.GetMount().MountFlags = []string{"noexec", "suid"}
+			mountResponse, err := controller.Mount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_UNSUPPORTED_MOUNT_FLAGS))
+			Expect(fakeExec.ExecuteCallCount()).To(Equal(0))
+		})
+		It("Should merge the default mount flags of the backend with the requested flags", func() {
+			ubiquityConfig.CsiConfig.MountOptions = ctl.MountOptionsConfig{
+				Allowed:  []string{"atime", "nodev", "nfsvers=4.1"},
+				Defaults: map[string][]string{"localhost": {"nosuid", "noatime", "nfsvers=3"}},
+			}
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			request.VolumeHandle.Metadata = map[string]string{"backend": "localhost"}
+			request.VolumeCapability.GetMount().MountFlags = []string{"atime", "nodev", "nfsvers=4.1"}
+			_, err := controller.Mount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			cmd, args := fakeExec.ExecuteArgsForCall(4)
+			Expect(cmd).To(Equal("mount"))
+			Expect(args).To(Equal([]string{"-o", "remount,bind,nosuid,atime,nodev", "/tmp/test/target"}))
+
+			request.VolumeCapability.GetMount().MountFlags = []string{"nfsvers=4.2"}
+			mountResponse, err := controller.Mount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_UNSUPPORTED_MOUNT_FLAGS))
+		})
+		It("Should stop when the context is cancelled and roll the publish back on retry", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := controller.Mount(ctx, request)
+			Expect(err).To(Equal(context.Canceled))
+			Expect(fakeExec.ExecuteCallCount()).To(Equal(0))
+
+			mountResponse, err := controller.Mount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mountResponse.GetResult()).ToNot(BeNil())
+			Expect(fakeExec.RemoveCallCount()).To(Equal(2))
+			Expect(fakeExec.RemoveArgsForCall(0)).To(Equal("/tmp/test/target"))
+			Expect(fakeExec.RemoveArgsForCall(1)).To(Equal("/var/lib/ubiquity-csi/staging/testVolume"))
+		})
+		It("Should succeed without mounting when the target is already mounted", func() {
+			fakeMounts(fakeExec, map[string]fakeMount{
+				"/var/lib/ubiquity-csi/staging/testVolume": {source: "/dev/sda1[/tmp/test/mnt2]", options: "rw"},
+				"/tmp/test/target":                         {source: "/dev/sda1[/tmp/test/mnt2]", options: "rw"},
+			}, nil)
+			mountResponse, err := controller.Mount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mountResponse.GetResult()).ToNot(BeNil())
+			for _, command := range executedCommands(fakeExec) {
+				Expect(command).ToNot(HavePrefix("mount"))
+			}
+			Expect(fakeExec.MkdirAllCallCount()).To(Equal(0))
+		})
+		It("Should fail with MOUNT_ERROR when the target is already mounted from another source", func() {
+			fakeMounts(fakeExec, map[string]fakeMount{
+				"/var/lib/ubiquity-csi/staging/testVolume": {source: "/dev/sda1[/tmp/test/mnt2]", options: "rw"},
+				"/tmp/test/target":                         {source: "/dev/sdb", options: "rw"},
+			}, nil)
+			mountResponse, err := controller.Mount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_MOUNT_ERROR))
+			Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorDescription()).To(ContainSubstring("/dev/sdb"))
+		})
+		It("Should fail with MOUNT_ERROR when the target is already mounted with another access", func() {
+			fakeMounts(fakeExec, map[string]fakeMount{
+				"/var/lib/ubiquity-csi/staging/testVolume": {source: "/dev/sda1[/tmp/test/mnt2]", options: "rw"},
+				"/tmp/test/target":                         {source: "/dev/sda1[/tmp/test/mnt2]", options: "rw"},
+			}, nil)
+			request.Readonly = true
+			mountResponse, err := controller.Mount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_MOUNT_ERROR))
+			Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorDescription()).To(ContainSubstring("readonly"))
+		})
+		It("Should fail with MOUNT_ERROR when the volume was not published", func() {
+			request.PublishVolumeInfo = nil
+			mountResponse, err := controller.Mount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_MOUNT_ERROR))
+		})
+		It("Should fail with VOLUME_DOES_NOT_EXIST when the mountpoint is missing", func() {
+			fakeExec.StatReturns(nil, errors.New("no such file"))
+			fakeExec.IsNotExistReturns(true)
+			mountResponse, err := controller.Mount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_VOLUME_DOES_NOT_EXIST))
+		})
+		It("Should fail with UNSUPPORTED_VOLUME_TYPE for block access on a file system backend", func() {
+			request.VolumeCapability = &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+			request.VolumeHandle.Metadata = map[string]string{"backend": "spectrum-scale"}
+			mountResponse, err := controller.Mount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_UNSUPPORTED_VOLUME_TYPE))
+			Expect(fakeExec.ExecuteCallCount()).To(Equal(0))
+		})
+		Context("with a block backend", func() {
+			var (
+				mounts       map[string]fakeMount
+				probe        []byte
+				probeErr     error
+				mountpointOf string
+			)
+			BeforeEach(func() {
+				mountpointInfo, err := os.Stat("/tmp/test/mnt2")
+				Expect(err).ToNot(HaveOccurred())
+				deviceInfo, err := os.Stat("/dev/null")
+				Expect(err).ToNot(HaveOccurred())
+				// scbe attaches the multipath device of the volume and mounts it on the mountpoint
+				mounts = map[string]fakeMount{"/tmp/test/mnt2": {source: "/dev/mapper/mpatha", fsType: "ext4"}}
+				probe, probeErr = nil, exitError(2)
+				mountpointOf = "/tmp/test/mnt2"
+				fakeMounts(fakeExec, mounts, func() ([]byte, error) { return probe, probeErr })
+				fakeExec.StatStub = func(path string) (os.FileInfo, error) {
+					switch path {
+					case "/tmp/test/target":
+						if _, ok := mounts[path]; !ok {
+							return nil, os.ErrNotExist
+						}
+						return deviceInfo, nil
+					case "/dev/mapper/mpatha", "/dev/mapper/mpathb":
+						return deviceInfo, nil
+					case mountpointOf:
+						return mountpointInfo, nil
+					}
+					return nil, os.ErrNotExist
+				}
+				fakeExec.IsNotExistStub = os.IsNotExist
+				fakeExec.HostnameReturns("node1", nil)
+				fakeClient.GetVolumeReturns(resources.GetVolumeResponse{Volume: resources.Volume{Name: "testVolume", Mountpoint: "/tmp/test/mnt2"}})
+				request.VolumeHandle.Metadata = map[string]string{"backend": "scbe"}
+			})
+			Context("for block access", func() {
+				BeforeEach(func() {
+					request.VolumeCapability = &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}}
+				})
+				It("Should unmount the ubiquity mount and bind mount the device on a target file", func() {
+					mountResponse, err := controller.Mount(context.Background(), request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountResponse.GetResult()).ToNot(BeNil())
+					path, _ := fakeExec.MkdirAllArgsForCall(0)
+					Expect(path).To(Equal("/tmp/test"))
+					Expect(executedCommands(fakeExec)).To(ContainElement("umount /tmp/test/mnt2"))
+					Expect(executedCommands(fakeExec)).To(ContainElement("touch /tmp/test/target"))
+					Expect(executedCommands(fakeExec)).To(ContainElement("mount --bind /dev/mapper/mpatha /tmp/test/target"))
+					Expect(mounts).ToNot(HaveKey("/tmp/test/mnt2"))
+
+					// the ubiquity mount is back when the last target is unpublished and the volume detached
+					unmountResponse, err := controller.Unount(context.Background(), csi.NodeUnpublishVolumeRequest{
+						Version:      &csi.Version{},
+						VolumeHandle: &csi.VolumeHandle{Id: "testVolume"},
+						TargetPath:   "/tmp/test/target",
+					})
+					Expect(err).ToNot(HaveOccurred())
+					Expect(unmountResponse.GetResult()).ToNot(BeNil())
+					Expect(mounts).To(Equal(map[string]fakeMount{"/tmp/test/mnt2": {source: "/dev/mapper/mpatha"}}))
+					Expect(fakeClient.DetachCallCount()).To(Equal(1))
+				})
+				It("Should refuse block access to a device mounted elsewhere", func() {
+					mounts["/mnt/other"] = fakeMount{source: "/dev/mapper/mpatha", fsType: "ext4"}
+					mountResponse, err := controller.Mount(context.Background(), request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_MOUNT_ERROR))
+					Expect(mounts).To(HaveKey("/tmp/test/mnt2"))
+					Expect(fakeExec.MkdirAllCallCount()).To(Equal(0))
+				})
+				It("Should not trust a device given in the publish info", func() {
+					delete(mounts, "/tmp/test/mnt2")
+					request.PublishVolumeInfo.Values["device"] = "/dev/mapper/mpathb"
+					mountResponse, err := controller.Mount(context.Background(), request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_MOUNT_ERROR))
+					Expect(mounts).To(BeEmpty())
+				})
+			})
+			Context("with the file system mounted by ubiquity", func() {
+				It("Should check the fs type of the ubiquity mount without probing or formatting the device", func() {
+					request.VolumeCapability.GetMount().FsType = "ext4"
+					mountResponse, err := controller.Mount(context.Background(), request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountResponse.GetResult()).ToNot(BeNil())
+					Expect(executedCommands(fakeExec)).To(ContainElement("mount --bind /tmp/test/mnt2 /var/lib/ubiquity-csi/staging/testVolume"))
+					for _, command := range executedCommands(fakeExec) {
+						Expect(command).ToNot(HavePrefix("blkid"))
+						Expect(command).ToNot(HavePrefix("mkfs"))
+					}
+				})
+				It("Should fail with UNSUPPORTED_FS_TYPE when ubiquity mounted another fs type", func() {
+					request.VolumeCapability.GetMount().FsType = "xfs"
+					mountResponse, err := controller.Mount(context.Background(), request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_UNSUPPORTED_FS_TYPE))
+					for _, command := range executedCommands(fakeExec) {
+						Expect(command).ToNot(HavePrefix("blkid"))
+					}
+				})
+				It("Should not format a device given in the publish info", func() {
+					delete(mounts, "/tmp/test/mnt2")
+					request.VolumeCapability.GetMount().FsType = "xfs"
+					request.PublishVolumeInfo.Values["device"] = "/dev/mapper/mpathb"
+					mountResponse, err := controller.Mount(context.Background(), request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_MOUNT_ERROR))
+					for _, command := range executedCommands(fakeExec) {
+						Expect(command).ToNot(HavePrefix("blkid"))
+						Expect(command).ToNot(HavePrefix("mkfs"))
+					}
+				})
+			})
+			Context("with a device attached without a mountpoint", func() {
+				BeforeEach(func() {
+					delete(mounts, "/tmp/test/mnt2")
+					mountpointOf = "/dev/mapper/mpatha"
+					request.PublishVolumeInfo.Values["mountpoint"] = "/dev/mapper/mpatha"
+				})
+				It("Should format an empty device with the requested fs type", func() {
+					request.VolumeCapability.GetMount().FsType = "xfs"
+					mountResponse, err := controller.Mount(context.Background(), request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountResponse.GetResult()).ToNot(BeNil())
+					Expect(executedCommands(fakeExec)).To(ContainElement("blkid -p -o export /dev/mapper/mpatha"))
+					Expect(executedCommands(fakeExec)).To(ContainElement("mkfs.xfs /dev/mapper/mpatha"))
+					Expect(mounts).To(HaveKeyWithValue("/var/lib/ubiquity-csi/staging/testVolume", fakeMount{source: "/dev/mapper/mpatha", fsType: "xfs"}))
+				})
+				It("Should not format a device that already has the requested fs type", func() {
+					request.VolumeCapability.GetMount().FsType = "ext4"
+					probe, probeErr = []byte("DEVNAME=/dev/mapper/mpatha\nUUID=1234\nTYPE=ext4\n"), nil
+					mountResponse, err := controller.Mount(context.Background(), request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountResponse.GetResult()).ToNot(BeNil())
+					for _, command := range executedCommands(fakeExec) {
+						Expect(command).ToNot(HavePrefix("mkfs"))
+					}
+				})
+				It("Should mount the device on the staging path with the file system mount flags", func() {
+					ubiquityConfig.CsiConfig.MountOptions = ctl.MountOptionsConfig{
+						Allowed:  []string{"noexec", "discard"},
+						Defaults: map[string][]string{"scbe": {"nosuid"}},
+					}
+					controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+					request.VolumeCapability.GetMount().FsType = "ext4"
+					request.VolumeCapability.GetMount().MountFlags = []string{"noexec", "discard"}
+					probe, probeErr = []byte("TYPE=ext4\n"), nil
+					mountResponse, err := controller.Mount(context.Background(), request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountResponse.GetResult()).ToNot(BeNil())
+					Expect(executedCommands(fakeExec)).To(ContainElement("mount -t ext4 -o nosuid,noexec,discard /dev/mapper/mpatha /var/lib/ubiquity-csi/staging/testVolume"))
+					Expect(executedCommands(fakeExec)).To(ContainElement("mount -o remount,bind,nosuid,noexec /tmp/test/target"))
+				})
+				It("Should only replace a default flag by the negation of a known boolean option", func() {
+					ubiquityConfig.CsiConfig.MountOptions = ctl.MountOptionsConfig{
+						Allowed:  []string{"exec", "nolock", "noac"},
+						Defaults: map[string][]string{"scbe": {"noexec", "lock", "ac", "nouser"}},
+					}
+					controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+					request.VolumeCapability.GetMount().FsType = "ext4"
+					request.VolumeCapability.GetMount().MountFlags = []string{"exec", "nolock", "noac"}
+					probe, probeErr = []byte("TYPE=ext4\n"), nil
+					mountResponse, err := controller.Mount(context.Background(), request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountResponse.GetResult()).ToNot(BeNil())
+					Expect(executedCommands(fakeExec)).To(ContainElement("mount -t ext4 -o exec,lock,ac,nouser,nolock,noac /dev/mapper/mpatha /var/lib/ubiquity-csi/staging/testVolume"))
+				})
+				It("Should fail with UNSUPPORTED_MOUNT_FLAGS when a requested flag is outside the configured allow-list", func() {
+					ubiquityConfig.CsiConfig.MountOptions = ctl.MountOptionsConfig{Allowed: []string{"noexec"}}
+					controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+					request.VolumeCapability.GetMount().FsType = "ext4"
+					request.VolumeCapability.GetMount().MountFlags = []string{"noexec", "discard"}
+					mountResponse, err := controller.Mount(context.Background(), request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_UNSUPPORTED_MOUNT_FLAGS))
+					Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorDescription()).To(ContainSubstring("discard"))
+					Expect(fakeExec.ExecuteCallCount()).To(Equal(0))
+					Expect(mounts).To(BeEmpty())
+				})
+				It("Should not probe the device again once it is staged", func() {
+					request.VolumeCapability.GetMount().FsType = "xfs"
+					mountResponse, err := controller.Mount(context.Background(), request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountResponse.GetResult()).ToNot(BeNil())
+					probes := fakeExec.ExecuteCallCount()
+
+					request.TargetPath = "/tmp/test/target2"
+					mountResponse, err = controller.Mount(context.Background(), request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountResponse.GetResult()).ToNot(BeNil())
+					for _, command := range executedCommands(fakeExec)[probes:] {
+						Expect(command).ToNot(HavePrefix("blkid"))
+					}
+					Expect(mounts).To(HaveKey("/tmp/test/target2"))
+				})
+				It("Should refuse to probe or format a device mounted elsewhere", func() {
+					request.VolumeCapability.GetMount().FsType = "xfs"
+					mounts["/mnt/other"] = fakeMount{source: "/dev/mapper/mpatha", fsType: "xfs"}
+					mountResponse, err := controller.Mount(context.Background(), request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_MOUNT_ERROR))
+					for _, command := range executedCommands(fakeExec) {
+						Expect(command).ToNot(HavePrefix("blkid"))
+						Expect(command).ToNot(HavePrefix("mkfs"))
+					}
+				})
+				It("Should fail with UNSUPPORTED_FS_TYPE when the device has another fs type", func() {
+					request.VolumeCapability.GetMount().FsType = "xfs"
+					probe, probeErr = []byte("TYPE=ext4\n"), nil
+					mountResponse, err := controller.Mount(context.Background(), request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_UNSUPPORTED_FS_TYPE))
+					Expect(mounts).To(BeEmpty())
+				})
+				It("Should refuse to format a device that carries a partition table", func() {
+					request.VolumeCapability.GetMount().FsType = "xfs"
+					probe, probeErr = []byte("PTTYPE=gpt\n"), nil
+					mountResponse, err := controller.Mount(context.Background(), request)
+					Expect(err).ToNot(HaveOccurred())
+					Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_MOUNT_ERROR))
+					Expect(mounts).To(BeEmpty())
+				})
+			})
+		})
+		It("Should fail with MOUNT_ERROR when the bind mount fails", func() {
+			fakeExec.ExecuteReturnsOnCall(1, []byte("permission denied"), errors.New("exit status 32"))
+			mountResponse, err := controller.Mount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_MOUNT_ERROR))
+		})
+	})
+
+	Context(".Unount", func() {
+		var (
+			request        csi.NodeUnpublishVolumeRequest
+			mountpointInfo os.FileInfo
+			executeCalls   int
+			statCalls      int
+		)
+		BeforeEach(func() {
+			request = csi.NodeUnpublishVolumeRequest{
+				Version:      &csi.Version{},
+				VolumeHandle: &csi.VolumeHandle{Id: "testVolume"},
+				TargetPath:   "/tmp/test/target",
+			}
+			var err error
+			mountpointInfo, err = os.Stat("/tmp/test/mnt2")
+			Expect(err).ToNot(HaveOccurred())
+			fakeExec.StatReturns(mountpointInfo, nil)
+			fakeExec.HostnameReturns("node1", nil)
+			// only the targets published by the plugin are unpublished
+			mountResponse, err := controller.Mount(context.Background(), csi.NodePublishVolumeRequest{
+				Version:           &csi.Version{},
+				VolumeHandle:      &csi.VolumeHandle{Id: "testVolume"},
+				PublishVolumeInfo: &csi.PublishVolumeInfo{Values: map[string]string{"mountpoint": "/tmp/test/mnt2"}},
+				TargetPath:        "/tmp/test/target",
+				VolumeCapability:  &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mountResponse.GetResult()).ToNot(BeNil())
+			executeCalls = fakeExec.ExecuteCallCount()
+			statCalls = fakeExec.StatCallCount()
+			fakeExec.ExecuteReturnsOnCall(executeCalls, []byte("/tmp/test/target\n"), nil)
+			fakeClient.GetVolumeReturns(resources.GetVolumeResponse{Volume: resources.Volume{Name: "testVolume", Mountpoint: "/tmp/test/mnt2"}})
+		})
+		It("Should unmount the volume and remove the target path", func() {
+			unmountResponse, err := controller.Unount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmountResponse.GetResult()).ToNot(BeNil())
+			cmd, args := fakeExec.ExecuteArgsForCall(executeCalls + 1)
+			Expect(cmd).To(Equal("umount"))
+			Expect(args).To(Equal([]string{"/tmp/test/target"}))
+			Expect(fakeExec.RemoveArgsForCall(0)).To(Equal("/tmp/test/target"))
+			Expect(fakeClient.DetachCallCount()).To(Equal(1))
+		})
+		It("Should release the staging mount and the attachment with the last target", func() {
+			mounted := map[string]bool{}
+			fakeExec.ExecuteStub = func(cmd string, args []string) ([]byte, error) {
+				path := args[len(args)-1]
+				switch cmd {
+				case "findmnt":
+					if !mounted[path] {
+						return nil, errors.New("exit status 1")
+					}
+					return []byte(path + "\n"), nil
+				case "mount":
+					mounted[path] = true
+				case "umount":
+					delete(mounted, path)
+				}
+				return nil, nil
+			}
+			fakeExec.HostnameReturns("node1", nil)
+			publishRequest := csi.NodePublishVolumeRequest{
+				Version:           &csi.Version{},
+				VolumeHandle:      &csi.VolumeHandle{Id: "otherVolume"},
+				PublishVolumeInfo: &csi.PublishVolumeInfo{Values: map[string]string{"mountpoint": "/tmp/test/mnt2"}},
+				VolumeCapability:  &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}},
+			}
+			for _, target := range []string{"/tmp/test/target1", "/tmp/test/target2"} {
+				publishRequest.TargetPath = target
+				mountResponse, err := controller.Mount(context.Background(), publishRequest)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(mountResponse.GetResult()).ToNot(BeNil())
+			}
+			Expect(mounted).To(HaveLen(3))
+
+			request.VolumeHandle.Id = "otherVolume"
+			request.TargetPath = "/tmp/test/target1"
+			unmountResponse, err := controller.Unount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmountResponse.GetResult()).ToNot(BeNil())
+			Expect(mounted).To(HaveKey("/var/lib/ubiquity-csi/staging/otherVolume"))
+			Expect(fakeClient.DetachCallCount()).To(Equal(0))
+
+			request.TargetPath = "/tmp/test/target2"
+			unmountResponse, err = controller.Unount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmountResponse.GetResult()).ToNot(BeNil())
+			Expect(mounted).To(BeEmpty())
+			Expect(fakeClient.DetachCallCount()).To(Equal(1))
+			Expect(fakeClient.DetachArgsForCall(0)).To(Equal(resources.DetachRequest{Name: "otherVolume", Host: "node1"}))
+		})
+		It("Should succeed when the target path is already gone", func() {
+			fakeExec.StatReturns(nil, errors.New("no such file"))
+			fakeExec.IsNotExistReturns(true)
+			unmountResponse, err := controller.Unount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmountResponse.GetResult()).ToNot(BeNil())
+			cmd, _ := fakeExec.ExecuteArgsForCall(executeCalls)
+			Expect(cmd).To(Equal("findmnt"))
+			Expect(fakeExec.RemoveArgsForCall(0)).To(Equal("/var/lib/ubiquity-csi/staging/testVolume"))
+		})
+		It("Should only remove the target path when it is not mounted", func() {
+			fakeExec.ExecuteReturnsOnCall(executeCalls, nil, errors.New("exit status 1"))
+			unmountResponse, err := controller.Unount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmountResponse.GetResult()).ToNot(BeNil())
+			cmd, _ := fakeExec.ExecuteArgsForCall(executeCalls + 1)
+			Expect(cmd).To(Equal("findmnt"))
+			Expect(fakeExec.RemoveArgsForCall(0)).To(Equal("/tmp/test/target"))
+		})
+		It("Should refuse to unmount a target that is not a mount of the volume", func() {
+			otherInfo, err := os.Stat("/tmp")
+			Expect(err).ToNot(HaveOccurred())
+			fakeExec.StatReturnsOnCall(statCalls+1, otherInfo, nil)
+			unmountResponse, err := controller.Unount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmountResponse.GetError().GetNodeUnpublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodeUnpublishVolumeError_UNMOUNT_ERROR))
+			Expect(fakeExec.ExecuteCallCount()).To(Equal(executeCalls + 1))
+		})
+		It("Should unpublish a mounted target published before a restart without a state directory", func() {
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			fakeExec.ExecuteReturnsOnCall(executeCalls+1, []byte("/tmp/test/target\n"), nil)
+			unmountResponse, err := controller.Unount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmountResponse.GetResult()).ToNot(BeNil())
+			cmd, args := fakeExec.ExecuteArgsForCall(executeCalls + 2)
+			Expect(cmd).To(Equal("umount"))
+			Expect(args).To(Equal([]string{"/tmp/test/target"}))
+			Expect(fakeExec.RemoveArgsForCall(0)).To(Equal("/tmp/test/target"))
+		})
+		It("Should fail with VOLUME_DOES_NOT_EXIST when ubiquity does not know the volume", func() {
+			fakeClient.GetVolumeReturns(resources.GetVolumeResponse{Error: errors.New("Volume not found")})
+			unmountResponse, err := controller.Unount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmountResponse.GetError().GetNodeUnpublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodeUnpublishVolumeError_VOLUME_DOES_NOT_EXIST))
+		})
+		It("Should fail with UNMOUNT_ERROR when umount fails", func() {
+			fakeExec.ExecuteReturnsOnCall(executeCalls+1, []byte("target is busy"), errors.New("exit status 32"))
+			unmountResponse, err := controller.Unount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmountResponse.GetError().GetNodeUnpublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodeUnpublishVolumeError_UNMOUNT_ERROR))
+			Expect(fakeExec.RemoveCallCount()).To(Equal(0))
+		})
+		It("Should refuse to unpublish a target the plugin did not publish", func() {
+			request.TargetPath = "/tmp/test/other"
+			fakeExec.ExecuteReturnsOnCall(executeCalls, nil, errors.New("exit status 1"))
+			unmountResponse, err := controller.Unount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmountResponse.GetError().GetNodeUnpublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodeUnpublishVolumeError_UNMOUNT_ERROR))
+			Expect(fakeExec.ExecuteCallCount()).To(Equal(executeCalls + 1))
+			Expect(fakeExec.RemoveCallCount()).To(Equal(0))
+		})
+		It("Should refuse to unpublish the target of another volume", func() {
+			request.VolumeHandle.Id = "otherVolume"
+			unmountResponse, err := controller.Unount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmountResponse.GetError().GetNodeUnpublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodeUnpublishVolumeError_UNMOUNT_ERROR))
+			Expect(fakeExec.ExecuteCallCount()).To(Equal(executeCalls))
+			Expect(fakeExec.RemoveCallCount()).To(Equal(0))
+		})
+		It("Should keep an interrupted unpublish recorded while the volume is published elsewhere", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := controller.Unount(ctx, request)
+			Expect(err).To(Equal(context.Canceled))
+			Expect(controller.InterruptedOperations()).To(Equal([]string{"unpublish/testVolume"}))
+
+			mountResponse, err := controller.Mount(context.Background(), csi.NodePublishVolumeRequest{
+				Version:           &csi.Version{},
+				VolumeHandle:      &csi.VolumeHandle{Id: "testVolume"},
+				PublishVolumeInfo: &csi.PublishVolumeInfo{Values: map[string]string{"mountpoint": "/tmp/test/mnt2"}},
+				TargetPath:        "/tmp/test/target2",
+				VolumeCapability:  &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}},
+			})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mountResponse.GetResult()).ToNot(BeNil())
+			Expect(controller.InterruptedOperations()).To(Equal([]string{"unpublish/testVolume"}))
+
+			fakeExec.ExecuteReturnsOnCall(fakeExec.ExecuteCallCount(), []byte("/tmp/test/target\n"), nil)
+			unmountResponse, err := controller.Unount(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(unmountResponse.GetResult()).ToNot(BeNil())
+			Expect(controller.InterruptedOperations()).To(BeEmpty())
+		})
+	})
+
+	Context(".RecoverPublishState", func() {
+		var (
+			stateDir       string
+			publishRequest csi.NodePublishVolumeRequest
+			mounted        map[string]bool
+		)
+		BeforeEach(func() {
+			var err error
+			stateDir, err = ioutil.TempDir("", "ubiquity-csi-state")
+			Expect(err).ToNot(HaveOccurred())
+			ubiquityConfig.CsiConfig.StatePath = stateDir
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			mountpointInfo, err := os.Stat("/tmp/test/mnt2")
+			Expect(err).ToNot(HaveOccurred())
+			fakeExec.StatReturns(mountpointInfo, nil)
+			mounted = map[string]bool{}
+			fakeExec.ExecuteStub = func(cmd string, args []string) ([]byte, error) {
+				path := args[len(args)-1]
+				switch cmd {
+				case "findmnt":
+					if !mounted[path] {
+						return nil, errors.New("exit status 1")
+					}
+					return []byte(path + "\n"), nil
+				case "mount":
+					mounted[path] = true
+				case "umount":
+					delete(mounted, path)
+				}
+				return nil, nil
+			}
+			publishRequest = csi.NodePublishVolumeRequest{
+				Version:           &csi.Version{},
+				VolumeHandle:      &csi.VolumeHandle{Id: "testVolume"},
+				PublishVolumeInfo: &csi.PublishVolumeInfo{Values: map[string]string{"mountpoint": "/tmp/test/mnt2"}},
+				TargetPath:        "/tmp/test/target",
+				VolumeCapability:  &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}},
+				Readonly:          true,
+			}
+		})
+		AfterEach(func() {
+			os.RemoveAll(stateDir)
+		})
+		It("Should mount again the published targets lost by a restart", func() {
+			_, err := controller.Mount(context.Background(), publishRequest)
+			Expect(err).ToNot(HaveOccurred())
+			mounted = map[string]bool{}
+
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			Expect(controller.RecoverPublishState(context.Background())).To(Succeed())
+			Expect(mounted).To(HaveKey("/tmp/test/target"))
+			Expect(mounted).To(HaveKey("/var/lib/ubiquity-csi/staging/testVolume"))
+			cmd, args := fakeExec.ExecuteArgsForCall(fakeExec.ExecuteCallCount() - 1)
+			Expect(cmd).To(Equal("mount"))
+			Expect(args).To(Equal([]string{"-o", "remount,bind,ro", "/tmp/test/target"}))
+		})
+		It("Should stop the recovery when the context is done", func() {
+			_, err := controller.Mount(context.Background(), publishRequest)
+			Expect(err).ToNot(HaveOccurred())
+			mounted = map[string]bool{}
+			executeCalls := fakeExec.ExecuteCallCount()
+
+			cancelled, cancel := context.WithCancel(context.Background())
+			cancel()
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			Expect(controller.RecoverPublishState(cancelled)).To(Equal(context.Canceled))
+			Expect(fakeExec.ExecuteCallCount()).To(Equal(executeCalls))
+			Expect(mounted).To(BeEmpty())
+		})
+		It("Should roll back a publish interrupted before it completed", func() {
+			journal := `{"/tmp/test/target": {"VolumeID": "testVolume", "TargetPath": "/tmp/test/target", "StagingPath": "/var/lib/ubiquity-csi/staging/testVolume", "State": "publishing"}}`
+			Expect(ioutil.WriteFile(filepath.Join(stateDir, "ubiquity-csi-publish.json"), []byte(journal), 0600)).To(Succeed())
+			mounted["/tmp/test/target"] = true
+			mounted["/var/lib/ubiquity-csi/staging/testVolume"] = true
+			Expect(controller.RecoverPublishState(context.Background())).To(Succeed())
+			Expect(mounted).To(BeEmpty())
+			Expect(fakeClient.DetachCallCount()).To(Equal(0))
+			content, err := ioutil.ReadFile(filepath.Join(stateDir, "ubiquity-csi-publish.json"))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(content)).To(Equal("{}"))
+		})
+		It("Should return the error of a journal that cannot be restored after a failed publish", func() {
+			fakeExec.ExecuteStub = func(cmd string, args []string) ([]byte, error) {
+				if cmd == "mount" {
+					os.RemoveAll(stateDir)
+					ioutil.WriteFile(stateDir, nil, 0600)
+					return []byte("permission denied"), errors.New("exit status 32")
+				}
+				return nil, errors.New("exit status 1")
+			}
+			_, err := controller.Mount(context.Background(), publishRequest)
+			Expect(err).To(HaveOccurred())
+		})
+		It("Should refuse to publish a volume on the target of another volume", func() {
+			_, err := controller.Mount(context.Background(), publishRequest)
+			Expect(err).ToNot(HaveOccurred())
+			publishRequest.VolumeHandle.Id = "otherVolume"
+			mountResponse, err := controller.Mount(context.Background(), publishRequest)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(mountResponse.GetError().GetNodePublishVolumeError().GetErrorCode()).To(Equal(csi.Error_NodePublishVolumeError_MOUNT_ERROR))
+		})
+	})
+
+	Context(".Reconcile", func() {
+		var mountInfo string
+		BeforeEach(func() {
+			fakeExec.HostnameReturns("node1", nil)
+			mountInfo = "36 25 0:32 / / rw,relatime shared:1 - ext4 /dev/sda1 rw\n"
+			fakeExec.ExecuteStub = func(cmd string, args []string) ([]byte, error) {
+				if cmd == "cat" {
+					return []byte(mountInfo), nil
+				}
+				return nil, nil
+			}
+			fakeClient.ListVolumesReturns(resources.ListVolumesResponse{Volumes: []resources.Volume{{Name: "testVolume", Backend: "scbe"}}})
+			fakeClient.GetVolumeConfigReturns(resources.GetVolumeConfigResponse{VolumeConfig: map[string]interface{}{"attach-to": "node1"}})
+		})
+		It("Should report the staging mounts of volumes that are not attached to the node", func() {
+			mountInfo += "40 36 8:16 / /var/lib/ubiquity-csi/staging/otherVolume rw - ext4 /dev/sdb rw\n"
+			mountInfo += "41 36 8:16 / /var/lib/ubiquity-csi/staging/testVolume rw - ext4 /dev/sdc rw\n"
+			fakeExec.GetGlobFilesReturns([]string{"/var/lib/ubiquity-csi/staging/otherVolume", "/var/lib/ubiquity-csi/staging/testVolume"}, nil)
+			report, err := controller.Reconcile(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.Host).To(Equal("node1"))
+			Expect(report.StaleMounts).To(Equal([]string{"/var/lib/ubiquity-csi/staging/otherVolume"}))
+			Expect(report.DanglingAttachments).To(BeEmpty())
+			Expect(report.Cleaned).To(BeFalse())
+		})
+		It("Should report the staging directories left without a mount", func() {
+			mountInfo += "40 36 8:16 / /var/lib/ubiquity-csi/staging/other\\040volume rw - ext4 /dev/sdb rw\n"
+			fakeExec.GetGlobFilesReturns([]string{"/var/lib/ubiquity-csi/staging/other volume", "/var/lib/ubiquity-csi/staging/orphan"}, nil)
+			report, err := controller.Reconcile(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.StaleMounts).To(Equal([]string{"/var/lib/ubiquity-csi/staging/other volume"}))
+			Expect(report.OrphanedStagingDirs).To(Equal([]string{"/var/lib/ubiquity-csi/staging/orphan"}))
+		})
+		It("Should only look up the attachment of the volumes of block backends", func() {
+			fakeClient.ListVolumesReturns(resources.ListVolumesResponse{Volumes: []resources.Volume{{Name: "testVolume", Backend: "scbe"}, {Name: "otherVolume", Backend: "localhost"}}})
+			report, err := controller.Reconcile(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.DanglingAttachments).To(Equal([]string{"testVolume"}))
+			Expect(fakeClient.GetVolumeConfigCallCount()).To(Equal(1))
+			Expect(fakeClient.GetVolumeConfigArgsForCall(0).Name).To(Equal("testVolume"))
+		})
+		It("Should detach the dangling attachments when the cleanup is enabled", func() {
+			ubiquityConfig.CsiConfig.ReconcileCleanup = true
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			report, err := controller.Reconcile(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(report.DanglingAttachments).To(Equal([]string{"testVolume"}))
+			Expect(report.Cleaned).To(BeTrue())
+			Expect(report.Errors).To(BeEmpty())
+			Expect(fakeClient.DetachCallCount()).To(Equal(1))
+			Expect(fakeClient.DetachArgsForCall(0)).To(Equal(resources.DetachRequest{Name: "testVolume", Host: "node1"}))
+		})
+		Context("with a published volume", func() {
+			var umounts []string
+			BeforeEach(func() {
+				ubiquityConfig.CsiConfig.ReconcileCleanup = true
+				controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+				mountpointInfo, err := os.Stat("/tmp/test/mnt2")
+				Expect(err).ToNot(HaveOccurred())
+				fakeExec.StatReturns(mountpointInfo, nil)
+				mountResponse, err := controller.Mount(context.Background(), csi.NodePublishVolumeRequest{
+					Version:           &csi.Version{},
+					VolumeHandle:      &csi.VolumeHandle{Id: "testVolume"},
+					PublishVolumeInfo: &csi.PublishVolumeInfo{Values: map[string]string{"mountpoint": "/tmp/test/mnt2"}},
+					TargetPath:        "/tmp/test/target",
+					VolumeCapability:  &csi.VolumeCapability{AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}}},
+				})
+				Expect(err).ToNot(HaveOccurred())
+				Expect(mountResponse.GetResult()).ToNot(BeNil())
+				mountInfo += "40 36 8:16 / /var/lib/ubiquity-csi/staging/testVolume rw - ext4 /dev/sdb rw\n"
+				mountInfo += "41 36 8:16 / /tmp/test/target rw - ext4 /dev/sdb rw\n"
+				fakeExec.GetGlobFilesReturns([]string{"/var/lib/ubiquity-csi/staging/testVolume"}, nil)
+				umounts = []string{}
+				fakeExec.ExecuteStub = func(cmd string, args []string) ([]byte, error) {
+					switch cmd {
+					case "cat":
+						return []byte(mountInfo), nil
+					case "umount":
+						umounts = append(umounts, args[0])
+					}
+					return nil, nil
+				}
+			})
+			It("Should keep the mounts of a mountpoint backend volume reported by ubiquity", func() {
+				fakeClient.ListVolumesReturns(resources.ListVolumesResponse{Volumes: []resources.Volume{{Name: "testVolume", Backend: "localhost", Mountpoint: "/tmp/test/mnt2"}}})
+				fakeClient.GetVolumeConfigReturns(resources.GetVolumeConfigResponse{VolumeConfig: map[string]interface{}{}})
+				report, err := controller.Reconcile(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(report.StaleMounts).To(BeEmpty())
+				Expect(report.DanglingAttachments).To(BeEmpty())
+				Expect(report.Errors).To(BeEmpty())
+				Expect(umounts).To(BeEmpty())
+				Expect(fakeClient.GetVolumeConfigCallCount()).To(Equal(0))
+			})
+			It("Should unmount the stale target before the staging mount it references", func() {
+				fakeClient.GetVolumeConfigReturns(resources.GetVolumeConfigResponse{VolumeConfig: map[string]interface{}{"attach-to": "node2"}})
+				report, err := controller.Reconcile(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(report.StaleMounts).To(Equal([]string{"/tmp/test/target", "/var/lib/ubiquity-csi/staging/testVolume"}))
+				Expect(report.Errors).To(BeEmpty())
+				Expect(umounts).To(Equal([]string{"/tmp/test/target", "/var/lib/ubiquity-csi/staging/testVolume"}))
+			})
+			It("Should keep a stale staging mount still referenced by a target", func() {
+				fakeClient.GetVolumeConfigReturns(resources.GetVolumeConfigResponse{VolumeConfig: map[string]interface{}{"attach-to": "node2"}})
+				fakeExec.ExecuteStub = func(cmd string, args []string) ([]byte, error) {
+					switch cmd {
+					case "cat":
+						return []byte(mountInfo), nil
+					case "umount":
+						umounts = append(umounts, args[0])
+						return []byte("target is busy"), errors.New("exit status 32")
+					}
+					return nil, nil
+				}
+				report, err := controller.Reconcile(context.Background())
+				Expect(err).ToNot(HaveOccurred())
+				Expect(umounts).To(Equal([]string{"/tmp/test/target"}))
+				Expect(report.Errors).To(HaveLen(2))
+				Expect(report.Errors[1]).To(ContainSubstring("still referenced by 1 targets"))
+			})
+		})
+		It("Should serve the last report on the admin endpoint", func() {
+			handler := controller.AdminHandler()
+			recorder := httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/reconcile", nil))
+			Expect(recorder.Code).To(Equal(http.StatusNotFound))
+
+			_, err := controller.Reconcile(context.Background())
+			Expect(err).ToNot(HaveOccurred())
+			recorder = httptest.NewRecorder()
+			handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/reconcile", nil))
+			Expect(recorder.Code).To(Equal(http.StatusOK))
+			Expect(recorder.Body.String()).To(ContainSubstring(`"Host":"node1"`))
+			Expect(recorder.Body.String()).To(ContainSubstring(`"DanglingAttachments":["testVolume"]`))
+
+			// the endpoint only reports, a reconciliation cannot be triggered through it
+			for _, method := range []string{"POST", "DELETE"} {
+				recorder = httptest.NewRecorder()
+				handler.ServeHTTP(recorder, httptest.NewRequest(method, "/reconcile", nil))
+				Expect(recorder.Code).To(Equal(http.StatusMethodNotAllowed))
+			}
+			Expect(fakeClient.ListVolumesCallCount()).To(Equal(1))
+		})
+	})
+
+	Context(".ProbeNode", func() {
+		var listener net.Listener
+		BeforeEach(func() {
+			var err error
+			listener, err = net.Listen("tcp", "127.0.0.1:0")
+			Expect(err).ToNot(HaveOccurred())
+			ubiquityConfig.Backends = []string{"localhost", "scbe"}
+			ubiquityConfig.LocalHostConfig.LocalhostPath = "/tmp/test/mnt2"
+			ubiquityConfig.UbiquityServer.Address = "127.0.0.1"
+			ubiquityConfig.UbiquityServer.Port = listener.Addr().(*net.TCPAddr).Port
+			fakeExec.IsDirStub = func(info os.FileInfo) bool { return info != nil }
+			mountpointInfo, err := os.Stat("/tmp/test/mnt2")
+			Expect(err).ToNot(HaveOccurred())
+			fakeExec.StatStub = func(path string) (os.FileInfo, error) {
+				if path == "/tmp/test/mnt2" {
+					return mountpointInfo, nil
+				}
+				return nil, nil
+			}
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+		})
+		AfterEach(func() {
+			listener.Close()
+		})
+		It("Should succeed when the node is ready", func() {
+			probeResponse, err := controller.ProbeNode(context.Background(), csi.ProbeNodeRequest{Version: &csi.Version{}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(probeResponse.GetResult()).ToNot(BeNil())
+			Expect(fakeExec.MkdirCallCount()).To(Equal(1))
+			Expect(fakeExec.RemoveCallCount()).To(Equal(1))
+		})
+		It("Should fail with MISSING_REQUIRED_HOST_DEPENDENCY when mkfs is missing", func() {
+			fakeExec.StatStub = func(path string) (os.FileInfo, error) {
+				if filepath.Base(path) == "mkfs.xfs" {
+					return nil, errors.New("no such file")
+				}
+				return nil, nil
+			}
+			probeResponse, err := controller.ProbeNode(context.Background(), csi.ProbeNodeRequest{Version: &csi.Version{}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(probeResponse.GetError().GetProbeNodeError().GetErrorCode()).To(Equal(csi.Error_ProbeNodeError_MISSING_REQUIRED_HOST_DEPENDENCY))
+			Expect(probeResponse.GetError().GetProbeNodeError().GetErrorDescription()).To(ContainSubstring("mkfs.xfs"))
+		})
+		It("Should fail with BAD_PLUGIN_CONFIG when the localhost path is not writable", func() {
+			fakeExec.MkdirReturns(errors.New("permission denied"))
+			probeResponse, err := controller.ProbeNode(context.Background(), csi.ProbeNodeRequest{Version: &csi.Version{}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(probeResponse.GetError().GetProbeNodeError().GetErrorCode()).To(Equal(csi.Error_ProbeNodeError_BAD_PLUGIN_CONFIG))
+		})
+		It("Should return the context error when the request is cancelled before the ubiquity server answers", func() {
+			cancelled, cancel := context.WithCancel(context.Background())
+			cancel()
+			_, err := controller.ProbeNode(cancelled, csi.ProbeNodeRequest{Version: &csi.Version{}})
+			Expect(err).To(Equal(context.Canceled))
+		})
+		It("Should fail with MISSING_REQUIRED_HOST_DEPENDENCY when the ubiquity server does not answer", func() {
+			listener.Close()
+			probeResponse, err := controller.ProbeNode(context.Background(), csi.ProbeNodeRequest{Version: &csi.Version{}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(probeResponse.GetError().GetProbeNodeError().GetErrorCode()).To(Equal(csi.Error_ProbeNodeError_MISSING_REQUIRED_HOST_DEPENDENCY))
+		})
+	})
+
+	Context(".GetNodeCapabilities", func() {
+		It("Should return a result without optional capabilities", func() {
+			capabilitiesResponse, err := controller.GetNodeCapabilities(context.Background(), csi.NodeGetCapabilitiesRequest{Version: &csi.Version{}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(capabilitiesResponse.GetResult()).ToNot(BeNil())
+			Expect(capabilitiesResponse.GetResult().GetCapabilities()).To(BeEmpty())
+		})
+	})
+
+	Context(".GetNodeID", func() {
+		It("Should publish the hostname by default", func() {
+			fakeExec.HostnameReturns("node1", nil)
+			nodeIDResponse, err := controller.GetNodeID(context.Background(), csi.GetNodeIDRequest{Version: &csi.Version{}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(nodeIDResponse.GetResult().GetNodeId().GetValues()).To(Equal(map[string]string{"hostname": "node1"}))
+		})
+		It("Should publish the configured keys and labels", func() {
+			ubiquityConfig.CsiConfig.NodeIdentity.Keys = []string{"hostname", "fqdn"}
+			ubiquityConfig.CsiConfig.NodeIdentity.Labels = map[string]string{"rack": "r1", "hostname": "other"}
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			fakeExec.HostnameReturns("node1", nil)
+			fakeExec.ExecuteReturns([]byte("node1.example.com\n"), nil)
+			nodeIDResponse, err := controller.GetNodeID(context.Background(), csi.GetNodeIDRequest{Version: &csi.Version{}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(nodeIDResponse.GetResult().GetNodeId().GetValues()).To(Equal(map[string]string{"hostname": "node1", "fqdn": "node1.example.com", "rack": "r1"}))
+		})
+		It("Should publish the initiators discovered on the node by default", func() {
+			fakeExec.HostnameReturns("node1", nil)
+			fakeExec.GetGlobFilesReturns([]string{"/sys/class/fc_host/host2/port_name", "/sys/class/fc_host/host1/port_name"}, nil)
+			fakeExec.ExecuteStub = func(cmd string, args []string) ([]byte, error) {
+				switch args[0] {
+				case "/etc/iscsi/initiatorname.iscsi":
+					return []byte("## generated\nInitiatorName=iqn.1994-05.com.redhat:node1\n"), nil
+				case "/sys/class/fc_host/host1/port_name":
+					return []byte("0x10000090fa000001\n"), nil
+				}
+				return []byte("0x10000090fa000002\n"), nil
+			}
+			nodeIDResponse, err := controller.GetNodeID(context.Background(), csi.GetNodeIDRequest{Version: &csi.Version{}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(nodeIDResponse.GetResult().GetNodeId().GetValues()).To(Equal(map[string]string{"hostname": "node1", "iqn": "iqn.1994-05.com.redhat:node1", "wwpns": "10000090fa000001,10000090fa000002"}))
+			Expect(fakeExec.GetGlobFilesArgsForCall(0)).To(Equal("/sys/class/fc_host/host*/port_name"))
+			cmd, _ := fakeExec.ExecuteArgsForCall(0)
+			Expect(cmd).To(Equal("cat"))
+		})
+		It("Should fail with MISSING_REQUIRED_HOST_DEPENDENCY when a configured initiator cannot be read", func() {
+			ubiquityConfig.CsiConfig.NodeIdentity.Keys = []string{"iqn"}
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			fakeExec.ExecuteReturns([]byte("No such file or directory"), errors.New("exit status 1"))
+			nodeIDResponse, err := controller.GetNodeID(context.Background(), csi.GetNodeIDRequest{Version: &csi.Version{}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(nodeIDResponse.GetError().GetGetNodeIdError().GetErrorCode()).To(Equal(csi.Error_GetNodeIDError_MISSING_REQUIRED_HOST_DEPENDENCY))
+		})
+		It("Should fail with BAD_PLUGIN_CONFIG for an unknown key", func() {
+			ubiquityConfig.CsiConfig.NodeIdentity.Keys = []string{"serial"}
+			controller = ctl.NewControllerWithClient(testLogger, fakeClient, fakeExec, ubiquityConfig)
+			nodeIDResponse, err := controller.GetNodeID(context.Background(), csi.GetNodeIDRequest{Version: &csi.Version{}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(nodeIDResponse.GetError().GetGetNodeIdError().GetErrorCode()).To(Equal(csi.Error_GetNodeIDError_BAD_PLUGIN_CONFIG))
+		})
+		It("Should fail with MISSING_REQUIRED_HOST_DEPENDENCY when a key cannot be read", func() {
+			fakeExec.HostnameReturns("", errors.New("no hostname"))
+			nodeIDResponse, err := controller.GetNodeID(context.Background(), csi.GetNodeIDRequest{Version: &csi.Version{}})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(nodeIDResponse.GetError().GetGetNodeIdError().GetErrorCode()).To(Equal(csi.Error_GetNodeIDError_MISSING_REQUIRED_HOST_DEPENDENCY))
+		})
+	})
+
+	Context(".DeleteVolume", func() {
+		var request csi.DeleteVolumeRequest
+		BeforeEach(func() {
+			request = csi.DeleteVolumeRequest{
+				Version:      &csi.Version{},
+				VolumeHandle: &csi.VolumeHandle{Id: "testVolume", Metadata: map[string]string{"backend": "localhost"}},
+			}
+			fakeClient.GetVolumeReturns(resources.GetVolumeResponse{Volume: resources.Volume{Name: "testVolume", Backend: "localhost"}})
+		})
+		It("Should fail with INVALID_VOLUME_ID when the volume handle is missing", func() {
+			request.VolumeHandle = nil
+			deleteVolumeResponse, err := controller.DeleteVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deleteVolumeResponse.GetError().GetDeleteVolumeError().GetErrorCode()).To(Equal(csi.Error_DeleteVolumeError_INVALID_VOLUME_ID))
+			Expect(fakeClient.RemoveVolumeCallCount()).To(Equal(0))
+		})
+		It("Should remove the volume from ubiquity", func() {
+			deleteVolumeResponse, err := controller.DeleteVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deleteVolumeResponse.GetResult()).ToNot(BeNil())
+			Expect(fakeClient.RemoveVolumeCallCount()).To(Equal(1))
+			Expect(fakeClient.RemoveVolumeArgsForCall(0).Name).To(Equal("testVolume"))
+		})
+		It("Should succeed without removing anything when the volume does not exist anymore", func() {
+			fakeClient.GetVolumeReturns(resources.GetVolumeResponse{Error: fmt.Errorf("Volume not found")})
+			deleteVolumeResponse, err := controller.DeleteVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deleteVolumeResponse.GetResult()).ToNot(BeNil())
+			Expect(fakeClient.RemoveVolumeCallCount()).To(Equal(0))
+		})
+		It("Should fail with VOLUME_DOES_NOT_EXIST when the volume belongs to another backend", func() {
+			request.VolumeHandle.Metadata["backend"] = "scbe"
+			deleteVolumeResponse, err := controller.DeleteVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deleteVolumeResponse.GetError().GetDeleteVolumeError().GetErrorCode()).To(Equal(csi.Error_DeleteVolumeError_VOLUME_DOES_NOT_EXIST))
+			Expect(fakeClient.RemoveVolumeCallCount()).To(Equal(0))
+		})
+		It("Should fail with VOLUME_IN_USE when the volume is still mounted", func() {
+			fakeClient.GetVolumeReturns(resources.GetVolumeResponse{Volume: resources.Volume{Name: "testVolume", Backend: "localhost", Mountpoint: "/tmp/test/mnt2"}})
+			deleteVolumeResponse, err := controller.DeleteVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deleteVolumeResponse.GetError().GetDeleteVolumeError().GetErrorCode()).To(Equal(csi.Error_DeleteVolumeError_VOLUME_IN_USE))
+			Expect(fakeClient.RemoveVolumeCallCount()).To(Equal(0))
+		})
+		It("Should fail with VOLUME_IN_USE when the volume is attached to a host", func() {
+			fakeClient.GetVolumeConfigReturns(resources.GetVolumeConfigResponse{VolumeConfig: map[string]interface{}{"attach-to": "node1"}})
+			deleteVolumeResponse, err := controller.DeleteVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deleteVolumeResponse.GetError().GetDeleteVolumeError().GetErrorCode()).To(Equal(csi.Error_DeleteVolumeError_VOLUME_IN_USE))
+			Expect(fakeClient.RemoveVolumeCallCount()).To(Equal(0))
+		})
+		It("Should fail with CALLER_NOT_AUTHORIZED when ubiquity refuses the removal", func() {
+			fakeClient.RemoveVolumeReturns(resources.RemoveVolumeResponse{Error: fmt.Errorf("user is not authorized")})
+			deleteVolumeResponse, err := controller.DeleteVolume(context.Background(), request)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(deleteVolumeResponse.GetError().GetDeleteVolumeError().GetErrorCode()).To(Equal(csi.Error_DeleteVolumeError_CALLER_NOT_AUTHORIZED))
+		})
+		It("Should fail when ubiquity client returns an error", func() {
+			fakeClient.RemoveVolumeReturns(resources.RemoveVolumeResponse{Error: fmt.Errorf("error occurred")})
+			_, err := controller.DeleteVolume(context.Background(), request)
+			Expect(err).To(HaveOccurred())
+		})
 	})
 })
+
+// fakeMount is a mount of the mount table simulated by fakeMounts
+type fakeMount struct {
+	source  string
+	fsType  string
+	options string
+}
+
+// fakeMounts answers findmnt from the mount table and records mount and umount in it,
+// blkid prints the probe of the device
+func fakeMounts(fakeExec *fakes.FakeExecutor, mounts map[string]fakeMount, probe func() ([]byte, error)) {
+	fakeExec.ExecuteStub = func(cmd string, args []string) ([]byte, error) {
+		last := args[len(args)-1]
+		switch cmd {
+		case "findmnt":
+			if args[3] == "--source" {
+				targets := ""
+				for target, mount := range mounts {
+					if mount.source == last {
+						targets += target + "\n"
+					}
+				}
+				if targets == "" {
+					return nil, errors.New("exit status 1")
+				}
+				return []byte(targets), nil
+			}
+			mount, ok := mounts[last]
+			if !ok {
+				return nil, errors.New("exit status 1")
+			}
+			switch args[2] {
+			case "SOURCE":
+				return []byte(mount.source + "\n"), nil
+			case "FSTYPE":
+				return []byte(mount.fsType + "\n"), nil
+			case "OPTIONS":
+				return []byte(mount.options + "\n"), nil
+			}
+			return []byte(last + "\n"), nil
+		case "mount":
+			switch {
+			case args[0] == "--bind":
+				// a bind mount of a device file is reported as a subpath of devtmpfs
+				mount, ok := mounts[args[1]]
+				if !ok {
+					mount = fakeMount{source: "devtmpfs[" + args[1] + "]"}
+				}
+				mounts[last] = mount
+			case args[0] == "-o":
+				mount := mounts[last]
+				mount.options = strings.TrimPrefix(args[1], "remount,bind,")
+				mounts[last] = mount
+			case args[0] == "-t":
+				mounts[last] = fakeMount{source: args[len(args)-2], fsType: args[1]}
+			case len(args) == 2:
+				mounts[last] = fakeMount{source: args[0]}
+			}
+		case "umount":
+			delete(mounts, last)
+		case "blkid":
+			return probe()
+		}
+		return nil, nil
+	}
+}
+
+// executedCommands returns the command lines run by the fake executor
+func executedCommands(fakeExec *fakes.FakeExecutor) []string {
+	commands := []string{}
+	for i := 0; i < fakeExec.ExecuteCallCount(); i++ {
+		cmd, args := fakeExec.ExecuteArgsForCall(i)
+		commands = append(commands, strings.Join(append([]string{cmd}, args...), " "))
+	}
+	return commands
+}
+
+// exitError returns the error of a command exiting with the status
+func exitError(status int) error {
+	return exec.Command("sh", "-c", fmt.Sprintf("exit %d", status)).Run()
+}
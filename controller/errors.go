@@ -0,0 +1,70 @@
+package controller
+
+import (
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// ubiquity server errors are returned as plain strings over http, these
+// helpers classify them so that they can be mapped to the csi error codes
+var (
+	notFoundErrorMessages        = []string{"not found", "does not exist", "doesn't exist"}
+	notAuthorizedErrorMessages   = []string{"not authorized", "unauthorized", "forbidden", "permission denied"}
+	nodeErrorMessages            = []string{"host", "node"}
+	alreadyAttachedErrorMessages = []string{"already attached", "already mapped", "attached to another"}
+	maxAttachedErrorMessages     = []string{"max attach", "maximum number", "too many"}
+	notAttachedErrorMessages     = []string{"not attached", "not mapped"}
+	attachedElsewhereMessages    = []string{"attached to another"}
+)
+
+func isNotFoundError(err error) bool {
+	return errorContainsAny(err, notFoundErrorMessages)
+}
+
+func isNotAuthorizedError(err error) bool {
+	return errorContainsAny(err, notAuthorizedErrorMessages)
+}
+
+// attachErrorCode maps a ubiquity attach failure to a controller publish error code,
+// it returns false when the failure has no specific code
+func attachErrorCode(err error) (csi.Error_ControllerPublishVolumeError_ControllerPublishVolumeErrorCode, bool) {
+	switch {
+	case errorContainsAny(err, alreadyAttachedErrorMessages):
+		return csi.Error_ControllerPublishVolumeError_VOLUME_ALREADY_PUBLISHED, true
+	case errorContainsAny(err, maxAttachedErrorMessages):
+		return csi.Error_ControllerPublishVolumeError_MAX_ATTACHED_NODES, true
+	case isNotFoundError(err) && errorContainsAny(err, nodeErrorMessages):
+		return csi.Error_ControllerPublishVolumeError_NODE_DOES_NOT_EXIST, true
+	case isNotFoundError(err):
+		return csi.Error_ControllerPublishVolumeError_VOLUME_DOES_NOT_EXIST, true
+	}
+	return csi.Error_ControllerPublishVolumeError_UNKNOWN, false
+}
+
+// detachErrorCode maps a ubiquity detach failure to a controller unpublish error code,
+// it returns false when the failure has no specific code
+func detachErrorCode(err error) (csi.Error_ControllerUnpublishVolumeError_ControllerUnpublishVolumeErrorCode, bool) {
+	switch {
+	case errorContainsAny(err, notAttachedErrorMessages), errorContainsAny(err, attachedElsewhereMessages):
+		return csi.Error_ControllerUnpublishVolumeError_VOLUME_NOT_ATTACHED_TO_SPECIFIED_NODE, true
+	case isNotFoundError(err) && errorContainsAny(err, nodeErrorMessages):
+		return csi.Error_ControllerUnpublishVolumeError_NODE_DOES_NOT_EXIST, true
+	case isNotFoundError(err):
+		return csi.Error_ControllerUnpublishVolumeError_VOLUME_DOES_NOT_EXIST, true
+	}
+	return csi.Error_ControllerUnpublishVolumeError_UNKNOWN, false
+}
+
+func errorContainsAny(err error, messages []string) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	for _, m := range messages {
+		if strings.Contains(msg, m) {
+			return true
+		}
+	}
+	return false
+}
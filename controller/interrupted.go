@@ -0,0 +1,148 @@
+package controller
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+)
+
+// interruptedOperation is an operation on a volume
+type interruptedOperation struct {
+	operation string
+	volumeID  string
+}
+
+// interruptedOperations records the operations abandoned when their context was
+// cancelled or timed out, until their retry on the same volume takes them back
+type interruptedOperations struct {
+	sync.Mutex
+	operations map[interruptedOperation]time.Time
+}
+
+// resumableOperations are the operations that take their record back when they are
+// retried, the other operations have nothing to clean up and are not recorded
+var resumableOperations = map[string]bool{
+	"create":    true,
+	"delete":    true,
+	"attach":    true,
+	"detach":    true,
+	"publish":   true,
+	"unpublish": true,
+}
+
+func newInterruptedOperations() *interruptedOperations {
+	return &interruptedOperations{operations: make(map[interruptedOperation]time.Time)}
+}
+
+func (i *interruptedOperations) record(volumeID string, operation string) {
+	if volumeID == "" || !resumableOperations[operation] {
+		return
+	}
+	i.Lock()
+	defer i.Unlock()
+	i.operations[interruptedOperation{operation: operation, volumeID: volumeID}] = time.Now()
+}
+
+// take forgets the interrupted operation on the volume and tells whether it was recorded
+func (i *interruptedOperations) take(volumeID string, operation string) bool {
+	i.Lock()
+	defer i.Unlock()
+	key := interruptedOperation{operation: operation, volumeID: volumeID}
+	_, ok := i.operations[key]
+	delete(i.operations, key)
+	return ok
+}
+
+// forget drops every interrupted operation on a volume that no longer exists
+func (i *interruptedOperations) forget(volumeID string) {
+	i.Lock()
+	defer i.Unlock()
+	for key := range i.operations {
+		if key.volumeID == volumeID {
+			delete(i.operations, key)
+		}
+	}
+}
+
+func (i *interruptedOperations) list() []string {
+	i.Lock()
+	defer i.Unlock()
+	operations := []string{}
+	for key := range i.operations {
+		operations = append(operations, key.operation+"/"+key.volumeID)
+	}
+	sort.Strings(operations)
+	return operations
+}
+
+//InterruptedOperations lists the operations interrupted by their context that were not retried yet, as operation/volume
+func (c *Controller) InterruptedOperations() []string {
+	return c.interrupted.list()
+}
+
+// resumeInterrupted takes back the record of an operation retried after an interruption
+// and tells whether there was one
+func (c *Controller) resumeInterrupted(volumeID string, operation string) bool {
+	if !c.interrupted.take(volumeID, operation) {
+		return false
+	}
+	c.logger.Printf("resuming-interrupted-%s-of-volume-%s", operation, volumeID)
+	return true
+}
+
+// isContextError tells whether the error comes from a cancelled or timed out context
+func isContextError(err error) bool {
+	return err == context.Canceled || err == context.DeadlineExceeded
+}
+
+// checkContext returns the error of a done context and records the operation as interrupted
+func (c *Controller) checkContext(ctx context.Context, volumeID string, operation string) error {
+	if err := ctx.Err(); err != nil {
+		c.logger.Printf("interrupted-%s-of-volume-%s-%#v", operation, volumeID, err)
+		c.interrupted.record(volumeID, operation)
+		return err
+	}
+	return nil
+}
+
+// callUbiquity runs a storage client call until it returns or the context is done, the
+// ubiquity client takes no context so an abandoned call goes on in the background: a
+// locked volume stays locked until the call returns and the operation is recorded as interrupted
+func (c *Controller) callUbiquity(ctx context.Context, volumeID string, operation string, call func()) error {
+	if err := c.checkContext(ctx, volumeID, operation); err != nil {
+		return err
+	}
+	held := c.volumeLocks.hold(volumeID)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if held {
+			defer c.volumeLocks.unlock(volumeID)
+		}
+		call()
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return c.checkContext(ctx, volumeID, operation)
+	}
+}
+
+// operationsPollInterval is how often WaitForOperations checks the volume locks
+const operationsPollInterval = 100 * time.Millisecond
+
+//WaitForOperations waits until no operation holds a volume, including the ubiquity calls
+//abandoned by interrupted operations, it tells whether they completed within the timeout
+func (c *Controller) WaitForOperations(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for !c.volumeLocks.idle() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(operationsPollInterval)
+	}
+	return true
+}
@@ -0,0 +1,273 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+// publishJournalFile is the name of the node publish-state journal in the state directory
+const publishJournalFile = "ubiquity-csi-publish.json"
+
+type publishState string
+
+// a target is journaled as publishing or unpublishing before the node touches it
+// and as published once it is mounted, an unpublished target leaves the journal
+const (
+	statePublishing   publishState = "publishing"
+	statePublished    publishState = "published"
+	stateUnpublishing publishState = "unpublishing"
+)
+
+// publishEntry records a volume published on a target, with what is needed to publish it again
+type publishEntry struct {
+	VolumeID    string
+	Backend     string
+	Mountpoint  string
+	Device      string
+	TargetPath  string
+	StagingPath string
+	Readonly    bool
+	Block       bool
+	FsType      string
+	MountFlags  []string
+	State       publishState
+	// UbiquityMountpoint is where ubiquity mounted the device of a block volume, the plugin
+	// unmounts it for block access and mounts it back before the volume is detached
+	UbiquityMountpoint string
+}
+
+// publishJournal persists the publish entries of the node keyed by target path,
+// it is kept in memory only when no state directory is configured
+type publishJournal struct {
+	sync.Mutex
+	path    string
+	entries map[string]publishEntry
+}
+
+func newPublishJournal(stateDir string) *publishJournal {
+	path := ""
+	if stateDir != "" {
+		path = filepath.Join(stateDir, publishJournalFile)
+	}
+	return &publishJournal{path: path, entries: make(map[string]publishEntry)}
+}
+
+// persistent tells whether the journal survives a restart of the plugin
+func (j *publishJournal) persistent() bool {
+	return j.path != ""
+}
+
+// load reads the journal written by a previous run of the plugin
+func (j *publishJournal) load() error {
+	j.Lock()
+	defer j.Unlock()
+	if j.path == "" {
+		return nil
+	}
+	content, err := ioutil.ReadFile(j.path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	entries := make(map[string]publishEntry)
+	if err := json.Unmarshal(content, &entries); err != nil {
+		return fmt.Errorf("failed to parse publish journal %s: %s", j.path, err.Error())
+	}
+	j.entries = entries
+	return nil
+}
+
+func (j *publishJournal) get(targetPath string) (publishEntry, bool) {
+	j.Lock()
+	defer j.Unlock()
+	entry, ok := j.entries[targetPath]
+	return entry, ok
+}
+
+// list returns the entries sorted by target path
+func (j *publishJournal) list() []publishEntry {
+	j.Lock()
+	defer j.Unlock()
+	entries := make([]publishEntry, 0, len(j.entries))
+	for _, entry := range j.entries {
+		entries = append(entries, entry)
+	}
+	sort.Slice(entries, func(a, b int) bool { return entries[a].TargetPath < entries[b].TargetPath })
+	return entries
+}
+
+// targets returns the target paths of the volume
+func (j *publishJournal) targets(volumeID string) []string {
+	j.Lock()
+	defer j.Unlock()
+	targets := []string{}
+	for _, entry := range j.entries {
+		if entry.VolumeID == volumeID {
+			targets = append(targets, entry.TargetPath)
+		}
+	}
+	return targets
+}
+
+// blockEntry returns an entry of the volume published for block access
+func (j *publishJournal) blockEntry(volumeID string) (publishEntry, bool) {
+	j.Lock()
+	defer j.Unlock()
+	for _, entry := range j.entries {
+		if entry.VolumeID == volumeID && entry.Block && entry.Device != "" {
+			return entry, true
+		}
+	}
+	return publishEntry{}, false
+}
+
+func (j *publishJournal) put(entry publishEntry) error {
+	j.Lock()
+	defer j.Unlock()
+	j.entries[entry.TargetPath] = entry
+	return j.save()
+}
+
+func (j *publishJournal) delete(targetPath string) error {
+	j.Lock()
+	defer j.Unlock()
+	delete(j.entries, targetPath)
+	return j.save()
+}
+
+// restore puts back the entry a failed operation started from
+func (j *publishJournal) restore(targetPath string, previous publishEntry, existed bool) error {
+	if existed {
+		return j.put(previous)
+	}
+	return j.delete(targetPath)
+}
+
+// save replaces the journal file atomically, a crash leaves either the old or the new journal
+func (j *publishJournal) save() error {
+	if j.path == "" {
+		return nil
+	}
+	content, err := json.MarshalIndent(j.entries, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(j.path), 0700); err != nil {
+		return err
+	}
+	tmp := j.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, content, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path)
+}
+
+// publishRequest rebuilds the NodePublishVolume request of the entry
+func (e publishEntry) publishRequest() csi.NodePublishVolumeRequest {
+	capability := &csi.VolumeCapability{}
+	if e.Block {
+		capability.AccessType = &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}
+	} else {
+		capability.AccessType = &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{FsType: e.FsType, MountFlags: e.MountFlags}}
+	}
+	publishInfo := map[string]string{"mountpoint": e.Mountpoint}
+	return csi.NodePublishVolumeRequest{
+		Version:           &csi.Version{},
+		VolumeHandle:      &csi.VolumeHandle{Id: e.VolumeID, Metadata: map[string]string{"backend": e.Backend}},
+		PublishVolumeInfo: &csi.PublishVolumeInfo{Values: publishInfo},
+		TargetPath:        e.TargetPath,
+		VolumeCapability:  capability,
+		Readonly:          e.Readonly,
+	}
+}
+
+func (e publishEntry) unpublishRequest() csi.NodeUnpublishVolumeRequest {
+	return csi.NodeUnpublishVolumeRequest{
+		Version:      &csi.Version{},
+		VolumeHandle: &csi.VolumeHandle{Id: e.VolumeID},
+		TargetPath:   e.TargetPath,
+	}
+}
+
+// RecoverPublishState replays the journal of a previous run: published targets are
+// mounted again when they are gone, half-finished publishes are rolled back and
+// half-finished unpublishes are completed, the recovery stops when the context is done
+func (c *Controller) RecoverPublishState(ctx context.Context) error {
+	c.logger.Printf("Entering-controller-recover-publish-state")
+	defer c.logger.Printf("Exiting-controller-recover-publish-state")
+	if err := c.journal.load(); err != nil {
+		return err
+	}
+	entries := c.journal.list()
+	for _, entry := range entries {
+		c.stagingRefs.add(entry.VolumeID, entry.TargetPath)
+	}
+	failed := []string{}
+	for _, entry := range entries {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		var err error
+		switch entry.State {
+		case statePublished:
+			var response csi.NodePublishVolumeResponse
+			if response, err = c.Mount(ctx, entry.publishRequest()); err == nil && response.GetError() != nil {
+				err = fmt.Errorf("%s", response.GetError().String())
+			}
+		case statePublishing:
+			err = c.rollbackPublish(entry)
+		case stateUnpublishing:
+			var response csi.NodeUnpublishVolumeResponse
+			if response, err = c.Unount(ctx, entry.unpublishRequest()); err == nil && response.GetError() != nil {
+				err = fmt.Errorf("%s", response.GetError().String())
+			}
+		}
+		if err != nil {
+			c.logger.Printf("error-recover-%s-of-volume-%s-on-%s-%#v", entry.State, entry.VolumeID, entry.TargetPath, err)
+			failed = append(failed, entry.TargetPath)
+		}
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("failed to recover the publish state of %v", failed)
+	}
+	return nil
+}
+
+// rollbackPublish undoes a publish interrupted before it was journaled as published,
+// the volume stays attached so that the retry of the CO can publish it again
+func (c *Controller) rollbackPublish(entry publishEntry) error {
+	mounted, err := c.isMounted(entry.TargetPath)
+	if err != nil {
+		return err
+	}
+	if mounted {
+		if out, err := c.exec.Execute("umount", []string{entry.TargetPath}); err != nil {
+			return fmt.Errorf("failed to unmount %s: %s: %s", entry.TargetPath, err.Error(), string(out))
+		}
+	}
+	if err := c.exec.Remove(entry.TargetPath); err != nil && !c.exec.IsNotExist(err) {
+		return err
+	}
+	if c.stagingRefs.count(entry.VolumeID) == 0 || c.stagingRefs.isLast(entry.VolumeID, entry.TargetPath) {
+		if entry.StagingPath != "" {
+			if err := c.unmountStaging(entry.VolumeID); err != nil {
+				return err
+			}
+		}
+		if err := c.restoreUbiquityMount(entry); err != nil {
+			return err
+		}
+	}
+	c.stagingRefs.remove(entry.VolumeID, entry.TargetPath)
+	return c.journal.delete(entry.TargetPath)
+}
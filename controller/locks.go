@@ -0,0 +1,61 @@
+package controller
+
+import (
+	"fmt"
+	"sync"
+)
+
+// volumeLocks serializes the operations on every volume while the operations on
+// different volumes run in parallel, an operation on a busy volume fails at once
+// so that the CO retries it instead of queuing behind a slow ubiquity call
+type volumeLocks struct {
+	sync.Mutex
+	holders map[string]int
+}
+
+func newVolumeLocks() *volumeLocks {
+	return &volumeLocks{holders: make(map[string]int)}
+}
+
+// tryLock locks the volume and tells whether it was free
+func (l *volumeLocks) tryLock(volumeID string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.holders[volumeID] > 0 {
+		return false
+	}
+	l.holders[volumeID] = 1
+	return true
+}
+
+// hold keeps a locked volume locked until a matching unlock, such as the end of
+// a ubiquity call that outlives the operation that started it, it tells whether
+// the volume was locked
+func (l *volumeLocks) hold(volumeID string) bool {
+	l.Lock()
+	defer l.Unlock()
+	if l.holders[volumeID] == 0 {
+		return false
+	}
+	l.holders[volumeID]++
+	return true
+}
+
+func (l *volumeLocks) unlock(volumeID string) {
+	l.Lock()
+	defer l.Unlock()
+	if l.holders[volumeID]--; l.holders[volumeID] <= 0 {
+		delete(l.holders, volumeID)
+	}
+}
+
+func operationPendingMessage(volumeID string) string {
+	return fmt.Sprintf("an operation is already pending for volume %s", volumeID)
+}
+
+// idle tells whether no volume is locked
+func (l *volumeLocks) idle() bool {
+	l.Lock()
+	defer l.Unlock()
+	return len(l.holders) == 0
+}
@@ -0,0 +1,338 @@
+package controller
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+)
+
+// targetPathPerm is the mode of the target directories created by NodePublishVolume
+const targetPathPerm = 0750
+
+// isMounted tells whether a file system is mounted on the path, findmnt exits
+// with an error and prints nothing when the path is not a mount point
+func (c *Controller) isMounted(path string) (bool, error) {
+	out, err := c.exec.Execute("findmnt", []string{"-n", "-o", "TARGET", "--mountpoint", path})
+	if err != nil {
+		if len(strings.TrimSpace(string(out))) == 0 {
+			return false, nil
+		}
+		return false, fmt.Errorf("failed to check mount point %s: %s: %s", path, err.Error(), string(out))
+	}
+	return strings.TrimSpace(string(out)) == path, nil
+}
+
+// bindMount mounts source on target, the options of a bind mount are only
+// applied by a remount so read-only and mount flags need a second call
+func (c *Controller) bindMount(source string, target string, readonly bool, flags []string) error {
+	if out, err := c.exec.Execute("mount", []string{"--bind", source, target}); err != nil {
+		return fmt.Errorf("failed to bind mount %s on %s: %s: %s", source, target, err.Error(), string(out))
+	}
+	options := []string{}
+	if readonly {
+		options = append(options, "ro")
+	}
+	options = append(options, flags...)
+	if len(options) == 0 {
+		return nil
+	}
+	remountOptions := "remount,bind," + strings.Join(options, ",")
+	if out, err := c.exec.Execute("mount", []string{"-o", remountOptions, target}); err != nil {
+		c.logger.Printf("error-remount-%s-%s, rolling back the bind mount", target, string(out))
+		c.exec.Execute("umount", []string{target})
+		return fmt.Errorf("failed to remount %s with %s: %s: %s", target, remountOptions, err.Error(), string(out))
+	}
+	return nil
+}
+
+// volumeDevice returns the block device backing an attached volume and whether ubiquity has
+// it mounted: the mountpoint itself when ubiquity attached a device node, or the device ubiquity
+// mounted on the mountpoint, such as the multipath device of a scbe volume. A device the plugin
+// unmounted from the mountpoint for block access is found in the journal
+func (c *Controller) volumeDevice(volumeID string, mountpoint string, mountpointInfo os.FileInfo) (string, bool, error) {
+	if mountpointInfo.Mode()&os.ModeDevice != 0 {
+		return mountpoint, false, nil
+	}
+	if source, err := c.mountSource(mountpoint); err == nil && strings.HasPrefix(source, "/dev/") {
+		return source, true, nil
+	}
+	if entry, ok := c.journal.blockEntry(volumeID); ok && entry.UbiquityMountpoint == mountpoint {
+		return entry.Device, false, nil
+	}
+	return "", false, fmt.Errorf("mountpoint %s is not backed by a block device", mountpoint)
+}
+
+// deviceMountpoints returns where the file system of the device is mounted, findmnt
+// exits with an error and prints nothing when the device is not mounted
+func (c *Controller) deviceMountpoints(device string) ([]string, error) {
+	out, err := c.exec.Execute("findmnt", []string{"-n", "-o", "TARGET", "--source", device})
+	if err != nil {
+		if len(strings.TrimSpace(string(out))) == 0 {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to check the mounts of device %s: %s: %s", device, err.Error(), string(out))
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// checkDeviceMounts returns where the file system of the device is mounted and refuses a device
+// mounted anywhere else than on the expected paths or on the journaled targets of the volume,
+// a bind mount of the file system reports the device as its source too
+func (c *Controller) checkDeviceMounts(volumeID string, device string, expected ...string) ([]string, error) {
+	mountpoints, err := c.deviceMountpoints(device)
+	if err != nil {
+		return nil, err
+	}
+	expected = append(expected, c.journal.targets(volumeID)...)
+	for _, mountpoint := range mountpoints {
+		if !containsString(expected, mountpoint) {
+			return nil, fmt.Errorf("device %s is mounted on %s, refusing to use it", device, mountpoint)
+		}
+	}
+	return mountpoints, nil
+}
+
+// checkMountedFsType compares the file system mounted on the path with the requested one,
+// the device of a mounted file system is never probed underneath its mount
+func (c *Controller) checkMountedFsType(device string, path string, fsType string) error {
+	out, err := c.exec.Execute("findmnt", []string{"-n", "-o", "FSTYPE", "--mountpoint", path})
+	if err != nil {
+		return fmt.Errorf("failed to find the fs type of mount point %s: %s: %s", path, err.Error(), string(out))
+	}
+	if existing := strings.TrimSpace(string(out)); existing != fsType {
+		return &fsMismatchError{device: device, existing: existing, requested: fsType}
+	}
+	return nil
+}
+
+// prepareFilesystem checks the file system of the device backing the volume and formats
+// the device on first use, it returns the device to mount on the staging path or nothing
+// when ubiquity mounted the file system itself. Only the device derived from the ubiquity
+// attachment is formatted, and only when it is not mounted
+func (c *Controller) prepareFilesystem(volumeID string, mountpoint string, mountpointInfo os.FileInfo, fsType string) (string, error) {
+	device, ubiquityMounted, err := c.volumeDevice(volumeID, mountpoint, mountpointInfo)
+	if err != nil {
+		return "", err
+	}
+	stagingPath := c.stagingPath(volumeID)
+	if ubiquityMounted {
+		// ubiquity created the file system when it attached the volume
+		if _, err := c.checkDeviceMounts(volumeID, device, mountpoint, stagingPath); err != nil {
+			return "", err
+		}
+		return "", c.checkMountedFsType(device, mountpoint, fsType)
+	}
+	if mountpointInfo.Mode()&os.ModeDevice == 0 {
+		return "", fmt.Errorf("volume %s is published for block access, its file system is not mounted", volumeID)
+	}
+	mountpoints, err := c.checkDeviceMounts(volumeID, device, stagingPath)
+	if err != nil {
+		return "", err
+	}
+	if containsString(mountpoints, stagingPath) {
+		return device, c.checkMountedFsType(device, stagingPath, fsType)
+	}
+	return device, c.ensureFilesystem(device, fsType)
+}
+
+// unmountUbiquityMount unmounts the file system ubiquity mounted on the device of a volume
+// published for block access, writes to the raw device underneath a mounted file system
+// corrupt it and the file system would be written back over them when it is unmounted
+func (c *Controller) unmountUbiquityMount(device string, mountpoint string) error {
+	c.logger.Printf("unmounting-%s-from-%s-for-block-access", device, mountpoint)
+	if out, err := c.exec.Execute("umount", []string{mountpoint}); err != nil {
+		return fmt.Errorf("failed to unmount %s from %s: %s: %s", device, mountpoint, err.Error(), string(out))
+	}
+	return nil
+}
+
+// restoreUbiquityMount mounts the device of a volume published for block access back on
+// the ubiquity mountpoint, ubiquity expects to find its mount when it detaches the volume
+func (c *Controller) restoreUbiquityMount(entry publishEntry) error {
+	if entry.UbiquityMountpoint == "" {
+		return nil
+	}
+	mounted, err := c.isMounted(entry.UbiquityMountpoint)
+	if err != nil || mounted {
+		return err
+	}
+	c.logger.Printf("mounting-%s-back-on-%s", entry.Device, entry.UbiquityMountpoint)
+	if out, err := c.exec.Execute("mount", []string{entry.Device, entry.UbiquityMountpoint}); err != nil {
+		return fmt.Errorf("failed to mount %s back on %s: %s: %s", entry.Device, entry.UbiquityMountpoint, err.Error(), string(out))
+	}
+	return nil
+}
+
+// bindMountDevice exposes the device as a file at the target path
+func (c *Controller) bindMountDevice(device string, target string, readonly bool) error {
+	if err := c.exec.MkdirAll(filepath.Dir(target), targetPathPerm); err != nil {
+		return fmt.Errorf("failed to create the parent directory of %s: %s", target, err.Error())
+	}
+	targetInfo, err := c.exec.Stat(target)
+	if err != nil {
+		if !c.exec.IsNotExist(err) {
+			return err
+		}
+		if out, err := c.exec.Execute("touch", []string{target}); err != nil {
+			return fmt.Errorf("failed to create target file %s: %s: %s", target, err.Error(), string(out))
+		}
+	} else if c.exec.IsDir(targetInfo) {
+		return fmt.Errorf("target path %s of a block volume is a directory", target)
+	}
+	return c.bindMount(device, target, readonly, nil)
+}
+
+// blkidNothingFound is the exit status of blkid when it finds nothing on the device
+const blkidNothingFound = 2
+
+// mkfsArgs holds the mkfs options of the supported file systems, mkfs.ext4 asks
+// for a confirmation on a whole device, the device is known to be empty here
+var mkfsArgs = map[string][]string{
+	"ext4": {"-F"},
+	"xfs":  {},
+}
+
+// fsMismatchError is returned when a device carries another file system than the requested one
+type fsMismatchError struct {
+	device, existing, requested string
+}
+
+func (e *fsMismatchError) Error() string {
+	return fmt.Sprintf("device %s is formatted with %s instead of the requested %s, it is never reformatted", e.device, e.existing, e.requested)
+}
+
+// probeDevice returns what blkid finds on the device, such as TYPE=ext4 or PTTYPE=gpt,
+// an empty map means the device carries no data
+func (c *Controller) probeDevice(device string) (map[string]string, error) {
+	out, err := c.exec.Execute("blkid", []string{"-p", "-o", "export", device})
+	if err != nil {
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == blkidNothingFound {
+				return map[string]string{}, nil
+			}
+		}
+		return nil, fmt.Errorf("failed to probe device %s: %s: %s", device, err.Error(), string(out))
+	}
+	probe := map[string]string{}
+	for _, line := range strings.Split(string(out), "\n") {
+		if kv := strings.SplitN(strings.TrimSpace(line), "=", 2); len(kv) == 2 && kv[0] != "DEVNAME" {
+			probe[kv[0]] = kv[1]
+		}
+	}
+	return probe, nil
+}
+
+// ensureFilesystem formats the device with the file system when it is empty, a device
+// carrying anything else than the requested file system is never touched
+func (c *Controller) ensureFilesystem(device string, fsType string) error {
+	probe, err := c.probeDevice(device)
+	if err != nil {
+		return err
+	}
+	if existing, ok := probe["TYPE"]; ok {
+		if existing != fsType {
+			return &fsMismatchError{device: device, existing: existing, requested: fsType}
+		}
+		return nil
+	}
+	if len(probe) > 0 {
+		return fmt.Errorf("device %s carries data without a file system (%v), refusing to format it", device, probe)
+	}
+	args, ok := mkfsArgs[fsType]
+	if !ok {
+		return fmt.Errorf("cannot format device %s with unsupported fs type %s", device, fsType)
+	}
+	c.logger.Printf("formatting-device-%s-with-%s", device, fsType)
+	if out, err := c.exec.Execute("mkfs."+fsType, append(args, device)); err != nil {
+		return fmt.Errorf("failed to format device %s with %s: %s: %s", device, fsType, err.Error(), string(out))
+	}
+	return nil
+}
+
+// mountDevice mounts the file system of the device on the target directory
+func (c *Controller) mountDevice(device string, fsType string, target string, readonly bool, flags []string) error {
+	options := []string{}
+	if readonly {
+		options = append(options, "ro")
+	}
+	options = append(options, flags...)
+	args := []string{"-t", fsType}
+	if len(options) > 0 {
+		args = append(args, "-o", strings.Join(options, ","))
+	}
+	if out, err := c.exec.Execute("mount", append(args, device, target)); err != nil {
+		return fmt.Errorf("failed to mount %s on %s: %s: %s", device, target, err.Error(), string(out))
+	}
+	return nil
+}
+
+// mountSource returns the device mounted on the path
+// mountReadonly tells whether the mount point is mounted read-only
+func (c *Controller) mountReadonly(path string) (bool, error) {
+	out, err := c.exec.Execute("findmnt", []string{"-n", "-o", "OPTIONS", "--mountpoint", path})
+	if err != nil {
+		return false, fmt.Errorf("failed to find the options of mount point %s: %s: %s", path, err.Error(), string(out))
+	}
+	return containsString(strings.Split(strings.TrimSpace(string(out)), ","), "ro"), nil
+}
+
+// checkPublishedTarget verifies that a target found mounted is the publish the request asks for:
+// a bind of the staging mount of the volume, or of its device for block access, with the same access
+func (c *Controller) checkPublishedTarget(volumeID string, targetPath string, mountpoint string, mountpointInfo os.FileInfo, block bool, readonly bool) error {
+	if block {
+		device, _, err := c.volumeDevice(volumeID, mountpoint, mountpointInfo)
+		if err != nil {
+			return err
+		}
+		targetInfo, err := c.exec.Stat(targetPath)
+		if err != nil {
+			return err
+		}
+		deviceInfo, err := c.exec.Stat(device)
+		if err != nil {
+			return err
+		}
+		if !os.SameFile(targetInfo, deviceInfo) {
+			return fmt.Errorf("target path %s is already mounted and is not device %s of volume %s", targetPath, device, volumeID)
+		}
+	} else {
+		stagingPath := c.stagingPath(volumeID)
+		staged, err := c.isMounted(stagingPath)
+		if err != nil {
+			return err
+		}
+		if !staged {
+			return fmt.Errorf("target path %s is already mounted while volume %s is not staged", targetPath, volumeID)
+		}
+		source, err := c.mountSource(targetPath)
+		if err != nil {
+			return err
+		}
+		expected, err := c.mountSource(stagingPath)
+		if err != nil {
+			return err
+		}
+		if source != expected {
+			return fmt.Errorf("target path %s is already mounted from %s instead of %s of volume %s", targetPath, source, expected, volumeID)
+		}
+	}
+	mountedReadonly, err := c.mountReadonly(targetPath)
+	if err != nil {
+		return err
+	}
+	if mountedReadonly != readonly {
+		return fmt.Errorf("target path %s is already mounted with readonly %t instead of %t", targetPath, mountedReadonly, readonly)
+	}
+	return nil
+}
+
+func (c *Controller) mountSource(path string) (string, error) {
+	out, err := c.exec.Execute("findmnt", []string{"-n", "-o", "SOURCE", "--mountpoint", path})
+	if err != nil {
+		return "", fmt.Errorf("failed to find the source of mount point %s: %s: %s", path, err.Error(), string(out))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
@@ -0,0 +1,99 @@
+package controller
+
+import (
+	"fmt"
+	"strings"
+)
+
+// defaultAllowedMountOptions are the mount options a CO may request when no allow-list is
+// configured, options such as suid, dev or exec that weaken the node are left out
+var defaultAllowedMountOptions = []string{
+	"noatime", "nodiratime", "relatime", "strictatime", "lazytime",
+	"nosuid", "nodev", "noexec",
+	"sync", "async", "dirsync",
+}
+
+// perMountOptions are the options a bind remount applies to a single mount point, the
+// other options configure the file system and only take effect when it is mounted
+var perMountOptions = map[string]bool{
+	"ro": true, "rw": true,
+	"suid": true, "nosuid": true, "dev": true, "nodev": true, "exec": true, "noexec": true,
+	"atime": true, "noatime": true, "diratime": true, "nodiratime": true,
+	"relatime": true, "norelatime": true, "strictatime": true, "nostrictatime": true,
+}
+
+// perMountFlags returns the flags a bind remount of the target applies
+func perMountFlags(flags []string) []string {
+	perMount := []string{}
+	for _, flag := range flags {
+		if perMountOptions[flag] {
+			perMount = append(perMount, flag)
+		}
+	}
+	return perMount
+}
+
+// mountOptionName returns the name of a mount option without its value
+func mountOptionName(option string) string {
+	return strings.SplitN(option, "=", 2)[0]
+}
+
+// mountOptionNegations maps the negation of the boolean mount options to the option it negates,
+// the other options starting with no, such as the nolock or noac of nfs, are options of their own
+var mountOptionNegations = map[string]string{
+	"noatime": "atime", "nodiratime": "diratime", "norelatime": "relatime",
+	"nostrictatime": "strictatime", "nolazytime": "lazytime",
+	"nosuid": "suid", "nodev": "dev", "noexec": "exec",
+	"nomand": "mand", "noiversion": "iversion",
+}
+
+// mountOptionFamily groups an option with its negation, atime and noatime
+// or nfsvers=3 and nfsvers=4.1 override each other
+func mountOptionFamily(option string) string {
+	name := mountOptionName(option)
+	if negated, ok := mountOptionNegations[name]; ok {
+		return negated
+	}
+	return name
+}
+
+// isAllowedMountOption tells whether the option is in the allow-list, an entry
+// without a value allows any value of the option
+func isAllowedMountOption(allowed []string, option string) bool {
+	for _, entry := range allowed {
+		if entry == option || (!strings.Contains(entry, "=") && entry == mountOptionName(option)) {
+			return true
+		}
+	}
+	return false
+}
+
+// mountFlags returns the flags of a publish on the backend: the default flags of the backend
+// followed by the flags requested by the CO, a requested flag replaces the default flag of
+// the same family, the requested flags must be in the allow-list
+func (c *Controller) mountFlags(backend string, requested []string) ([]string, error) {
+	allowed := c.config.CsiConfig.MountOptions.Allowed
+	if len(allowed) == 0 {
+		allowed = defaultAllowedMountOptions
+	}
+	for _, flag := range requested {
+		if !isAllowedMountOption(allowed, flag) {
+			return nil, fmt.Errorf("mount flag %s is not allowed", flag)
+		}
+	}
+
+	flags := []string{}
+	families := make(map[string]int)
+	for _, flag := range append(append([]string{}, c.config.CsiConfig.MountOptions.Defaults[backend]...), requested...) {
+		if flag == "" {
+			continue
+		}
+		if i, ok := families[mountOptionFamily(flag)]; ok {
+			flags[i] = flag
+			continue
+		}
+		families[mountOptionFamily(flag)] = len(flags)
+		flags = append(flags, flag)
+	}
+	return flags, nil
+}
@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// the identifiers a node can publish in its node id
+const (
+	nodeIDHostnameKey = "hostname"
+	nodeIDFQDNKey     = "fqdn"
+	nodeIDIQNKey      = "iqn"
+	nodeIDWWPNsKey    = "wwpns"
+
+	// nodeIDInstanceKey was published by earlier versions of the plugin, it holds the hostname
+	nodeIDInstanceKey = "instanceID"
+)
+
+const (
+	iscsiInitiatorNameFile = "/etc/iscsi/initiatorname.iscsi"
+	fcHostPortNamesPattern = "/sys/class/fc_host/host*/port_name"
+)
+
+// defaultNodeIDKeys are published when the configuration does not list any
+var defaultNodeIDKeys = []string{nodeIDHostnameKey}
+
+// discoveredNodeIDKeys are also published when the configuration does not list any keys
+// and the node has them, so that a node missing from the Hosts map still reports its initiators
+var discoveredNodeIDKeys = []string{nodeIDIQNKey, nodeIDWWPNsKey}
+
+// nodeIDReaders read the value of each node id key on the local node
+var nodeIDReaders = map[string]func(c *Controller) (string, error){
+	nodeIDHostnameKey: (*Controller).readHostname,
+	nodeIDFQDNKey:     (*Controller).readFQDN,
+	nodeIDIQNKey:      (*Controller).readIQN,
+	nodeIDWWPNsKey:    (*Controller).readWWPNs,
+}
+
+// nodeIDError is returned when the node id cannot be built, it carries the csi error code to report
+type nodeIDError struct {
+	code csi.Error_GetNodeIDError_GetNodeIDErrorCode
+	msg  string
+}
+
+func (e *nodeIDError) Error() string {
+	return e.msg
+}
+
+// buildNodeID collects the configured identifiers of the local node and the custom labels
+func (c *Controller) buildNodeID() (*csi.NodeID, error) {
+	identity := c.config.CsiConfig.NodeIdentity
+	keys := identity.Keys
+	if len(keys) == 0 {
+		keys = defaultNodeIDKeys
+	}
+	values := make(map[string]string)
+	for k, v := range identity.Labels {
+		values[k] = v
+	}
+	for _, key := range keys {
+		reader, ok := nodeIDReaders[key]
+		if !ok {
+			return nil, &nodeIDError{code: csi.Error_GetNodeIDError_BAD_PLUGIN_CONFIG, msg: fmt.Sprintf("unknown node identity key %s", key)}
+		}
+		value, err := reader(c)
+		if err != nil {
+			return nil, &nodeIDError{code: csi.Error_GetNodeIDError_MISSING_REQUIRED_HOST_DEPENDENCY, msg: fmt.Sprintf("failed to read node %s: %s", key, err.Error())}
+		}
+		values[key] = value
+	}
+	if len(identity.Keys) == 0 {
+		for _, key := range discoveredNodeIDKeys {
+			value, err := nodeIDReaders[key](c)
+			if err != nil {
+				c.logger.Printf("node-%s-not-discovered-%s", key, err.Error())
+				continue
+			}
+			values[key] = value
+		}
+	}
+	return &csi.NodeID{Values: values}, nil
+}
+
+// resolveNodeHost returns the ubiquity host name of the node identified by the node id
+func (c *Controller) resolveNodeHost(nid *csi.NodeID) (string, error) {
+	values := nid.GetValues()
+	if hostname := values[nodeIDHostnameKey]; hostname != "" {
+		return hostname, nil
+	}
+	if hostname := values[nodeIDInstanceKey]; hostname != "" {
+		return hostname, nil
+	}
+	if fqdn := values[nodeIDFQDNKey]; fqdn != "" {
+		return strings.SplitN(fqdn, ".", 2)[0], nil
+	}
+
+	// the remaining identifiers are mapped to host names by the configuration,
+	// keys are looked up in order so that the resolution is deterministic
+	hosts := c.config.CsiConfig.NodeIdentity.Hosts
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range strings.Split(values[k], ",") {
+			if host, ok := hosts[v]; ok {
+				return host, nil
+			}
+		}
+	}
+	return "", fmt.Errorf("cannot resolve the host of node id %v", values)
+}
+
+func (c *Controller) readHostname() (string, error) {
+	return c.exec.Hostname()
+}
+
+func (c *Controller) readFQDN() (string, error) {
+	out, err := c.exec.Execute("hostname", []string{"-f"})
+	if err != nil {
+		return "", err
+	}
+	fqdn := strings.TrimSpace(string(out))
+	if fqdn == "" {
+		return "", fmt.Errorf("hostname -f returned an empty name")
+	}
+	return fqdn, nil
+}
+
+// readIQN reads the iscsi initiator name, the file holds a line such as InitiatorName=iqn.1994-05.com.redhat:node1
+func (c *Controller) readIQN() (string, error) {
+	content, err := c.exec.Execute("cat", []string{iscsiInitiatorNameFile})
+	if err != nil {
+		return "", fmt.Errorf("failed to read %s: %s: %s", iscsiInitiatorNameFile, err.Error(), string(content))
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if strings.HasPrefix(line, "InitiatorName=") {
+			return strings.TrimPrefix(line, "InitiatorName="), nil
+		}
+	}
+	return "", fmt.Errorf("no InitiatorName in %s", iscsiInitiatorNameFile)
+}
+
+// readWWPNs reads the port names of the fibre channel hosts, comma separated
+func (c *Controller) readWWPNs() (string, error) {
+	files, err := c.exec.GetGlobFiles(fcHostPortNamesPattern)
+	if err != nil {
+		return "", err
+	}
+	wwpns := []string{}
+	for _, file := range files {
+		content, err := c.exec.Execute("cat", []string{file})
+		if err != nil {
+			return "", fmt.Errorf("failed to read %s: %s: %s", file, err.Error(), string(content))
+		}
+		wwpns = append(wwpns, strings.TrimPrefix(strings.TrimSpace(string(content)), "0x"))
+	}
+	if len(wwpns) == 0 {
+		return "", fmt.Errorf("no fibre channel host found")
+	}
+	sort.Strings(wwpns)
+	return strings.Join(wwpns, ","), nil
+}
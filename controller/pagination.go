@@ -0,0 +1,56 @@
+package controller
+
+import (
+	"encoding/base64"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/midoblgsm/ubiquity/resources"
+)
+
+// listVolumesTokenPrefix marks the list volumes tokens issued by this plugin
+const listVolumesTokenPrefix = "ubiquity-csi-volumes:"
+
+// A list volumes token carries the name of the last volume of the previous page. Volumes are
+// paged in name order, so a page starts right after that name whatever volumes were added or
+// removed in between.
+
+func encodeListVolumesToken(lastVolumeName string) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(listVolumesTokenPrefix + lastVolumeName))
+}
+
+func decodeListVolumesToken(token string) (string, error) {
+	decoded, err := base64.RawURLEncoding.DecodeString(token)
+	if err != nil || !strings.HasPrefix(string(decoded), listVolumesTokenPrefix) {
+		return "", fmt.Errorf("invalid starting token %s", token)
+	}
+	return strings.TrimPrefix(string(decoded), listVolumesTokenPrefix), nil
+}
+
+// pageVolumes sorts the volumes by name and returns the page starting after the token along
+// with the token of the next page, which is empty on the last page
+func pageVolumes(volumes []resources.Volume, startingToken string, maxEntries uint32) ([]resources.Volume, string, error) {
+	sorted := make([]resources.Volume, len(volumes))
+	copy(sorted, volumes)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Name < sorted[j].Name })
+
+	start := 0
+	if startingToken != "" {
+		after, err := decodeListVolumesToken(startingToken)
+		if err != nil {
+			return nil, "", err
+		}
+		start = sort.Search(len(sorted), func(i int) bool { return sorted[i].Name > after })
+	}
+
+	end := len(sorted)
+	if maxEntries > 0 && uint64(start)+uint64(maxEntries) < uint64(end) {
+		end = start + int(maxEntries)
+	}
+	page := sorted[start:end]
+	if end == len(sorted) || len(page) == 0 {
+		return page, "", nil
+	}
+	return page, encodeListVolumesToken(page[len(page)-1].Name), nil
+}
@@ -0,0 +1,161 @@
+package controller
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// backendParameterKey selects the ubiquity backend of a volume, it is accepted by every backend
+const backendParameterKey = "backend"
+
+// manifest keys under which the parameter schemas are published
+const (
+	manifestBackendsKey         = "backends"
+	manifestParametersKeyPrefix = "parameters."
+)
+
+type parameterType string
+
+const (
+	stringParameter parameterType = "string"
+	intParameter    parameterType = "int"
+	boolParameter   parameterType = "bool"
+)
+
+// parameterSchema describes a CreateVolume parameter accepted by a backend
+type parameterSchema struct {
+	Name        string        `json:"name"`
+	Type        parameterType `json:"type"`
+	Values      []string      `json:"values,omitempty"`
+	Default     string        `json:"default,omitempty"`
+	Required    bool          `json:"required,omitempty"`
+	Description string        `json:"description,omitempty"`
+}
+
+// backendParameterSchemas lists the CreateVolume parameters accepted by each backend,
+// the volume size is given by the capacity range and is not a parameter
+var backendParameterSchemas = map[string][]parameterSchema{
+	"localhost": {},
+	"spectrum-scale": {
+		{Name: "filesystem", Type: stringParameter, Description: "file system of the fileset, the configured default file system when empty"},
+		{Name: "type", Type: stringParameter, Values: []string{"fileset", "lightweight"}, Default: "fileset", Description: "kind of volume created in the file system"},
+		{Name: "fileset", Type: stringParameter, Description: "existing fileset to expose as the volume"},
+		{Name: "directory", Type: stringParameter, Description: "directory of a lightweight volume"},
+		{Name: "uid", Type: intParameter, Description: "owner of the volume root directory"},
+		{Name: "gid", Type: intParameter, Description: "group of the volume root directory"},
+		{Name: "inode-limit", Type: intParameter, Description: "maximum number of inodes of the fileset"},
+		{Name: "isPreexisting", Type: boolParameter, Default: "false", Description: "expose the existing fileset instead of creating one"},
+	},
+	"scbe": {
+		{Name: "profile", Type: stringParameter, Description: "storage service the volume is provisioned from, the configured default service when empty"},
+		{Name: "fstype", Type: stringParameter, Values: []string{"ext4", "xfs"}, Default: "ext4", Description: "file system created on the volume"},
+	},
+}
+
+// invalidParameterError is returned when the CreateVolume parameters do not match the backend schema
+type invalidParameterError struct {
+	msg string
+}
+
+func (e *invalidParameterError) Error() string {
+	return e.msg
+}
+
+func newInvalidParameterError(format string, args ...interface{}) error {
+	return &invalidParameterError{msg: fmt.Sprintf(format, args...)}
+}
+
+// validateParameters checks the parameters against the backend schema and
+// returns them with the defaults of the missing optional parameters
+func validateParameters(backend string, params map[string]string) (map[string]string, error) {
+	schemas, ok := backendParameterSchemas[backend]
+	if !ok {
+		return nil, newInvalidParameterError("unsupported backend %q, supported backends are %s", backend, strings.Join(supportedBackends(), ", "))
+	}
+	known := map[string]parameterSchema{}
+	for _, schema := range schemas {
+		known[schema.Name] = schema
+	}
+	for k, v := range params {
+		if k == backendParameterKey {
+			continue
+		}
+		schema, ok := known[k]
+		if !ok {
+			return nil, newInvalidParameterError("unknown parameter %q for backend %s", k, backend)
+		}
+		if err := schema.validate(v); err != nil {
+			return nil, err
+		}
+	}
+
+	validated := make(map[string]string)
+	for k, v := range params {
+		validated[k] = v
+	}
+	for _, schema := range schemas {
+		if _, ok := validated[schema.Name]; ok {
+			continue
+		}
+		if schema.Required {
+			return nil, newInvalidParameterError("missing required parameter %q for backend %s", schema.Name, backend)
+		}
+		if schema.Default != "" {
+			validated[schema.Name] = schema.Default
+		}
+	}
+	validated[backendParameterKey] = backend
+	return validated, nil
+}
+
+func (p parameterSchema) validate(value string) error {
+	switch p.Type {
+	case intParameter:
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return newInvalidParameterError("parameter %q must be an integer, got %q", p.Name, value)
+		}
+	case boolParameter:
+		if _, err := strconv.ParseBool(value); err != nil {
+			return newInvalidParameterError("parameter %q must be a boolean, got %q", p.Name, value)
+		}
+	}
+	if len(p.Values) > 0 && !containsString(p.Values, value) {
+		return newInvalidParameterError("parameter %q must be one of %s, got %q", p.Name, strings.Join(p.Values, ", "), value)
+	}
+	return nil
+}
+
+func supportedBackends() []string {
+	backends := make([]string, 0, len(backendParameterSchemas))
+	for backend := range backendParameterSchemas {
+		backends = append(backends, backend)
+	}
+	sort.Strings(backends)
+	return backends
+}
+
+// parametersManifest publishes the parameter schemas of the enabled backends in the plugin manifest,
+// each schema is a json list stored under parameters.<backend>
+func (c *Controller) parametersManifest() (map[string]string, error) {
+	backends := []string{}
+	for _, backend := range c.config.Backends {
+		if _, ok := backendParameterSchemas[backend]; ok {
+			backends = append(backends, backend)
+		}
+	}
+	if len(c.config.Backends) == 0 {
+		backends = supportedBackends()
+	}
+	manifest := map[string]string{manifestBackendsKey: strings.Join(backends, ",")}
+	for _, backend := range backends {
+		schema, err := json.Marshal(backendParameterSchemas[backend])
+		if err != nil {
+			return nil, err
+		}
+		manifest[manifestParametersKeyPrefix+backend] = string(schema)
+	}
+	return manifest, nil
+}
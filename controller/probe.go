@@ -0,0 +1,127 @@
+package controller
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+)
+
+// ubiquityServerProbeTimeout bounds the connection to the ubiquity server made by ProbeNode
+const ubiquityServerProbeTimeout = 5 * time.Second
+
+// localhostProbeDir is created and removed in the localhost path to check that it is writable
+const localhostProbeDir = ".ubiquity-csi-probe"
+
+// nodeBinaries are needed by the node service whatever the backends
+var nodeBinaries = []string{"mount", "umount", "findmnt"}
+
+// blockNodeBinaries are needed to format the devices of block backends
+var blockNodeBinaries = []string{"blkid"}
+
+// probeError is returned when a node check fails, it carries the csi error code to report
+type probeError struct {
+	code csi.Error_ProbeNodeError_ProbeNodeErrorCode
+	msg  string
+}
+
+func (e *probeError) Error() string {
+	return e.msg
+}
+
+func newProbeError(code csi.Error_ProbeNodeError_ProbeNodeErrorCode, format string, args ...interface{}) error {
+	return &probeError{code: code, msg: fmt.Sprintf(format, args...)}
+}
+
+// probeNode checks the host dependencies and the configuration of the enabled backends
+func (c *Controller) probeNode(ctx context.Context) error {
+	if err := c.probeBinaries(); err != nil {
+		return err
+	}
+	if containsString(c.config.Backends, "localhost") {
+		if err := c.probeLocalhostPath(); err != nil {
+			return err
+		}
+	}
+	return c.probeUbiquityServer(ctx)
+}
+
+func (c *Controller) probeBinaries() error {
+	binaries := append([]string{}, nodeBinaries...)
+	for _, backend := range c.config.Backends {
+		caps, ok := backendCapabilitiesTable[backend]
+		if !ok {
+			return newProbeError(csi.Error_ProbeNodeError_BAD_PLUGIN_CONFIG, "unsupported backend %s", backend)
+		}
+		if !caps.block {
+			continue
+		}
+		binaries = append(binaries, blockNodeBinaries...)
+		for _, fsType := range caps.fsTypes {
+			binaries = append(binaries, "mkfs."+fsType)
+		}
+	}
+	for _, binary := range binaries {
+		if !c.lookPath(binary) {
+			return newProbeError(csi.Error_ProbeNodeError_MISSING_REQUIRED_HOST_DEPENDENCY, "%s is not installed", binary)
+		}
+	}
+	return nil
+}
+
+// lookPath tells whether the binary is in one of the PATH directories
+func (c *Controller) lookPath(binary string) bool {
+	for _, dir := range filepath.SplitList(os.Getenv("PATH")) {
+		if dir == "" {
+			continue
+		}
+		if info, err := c.exec.Stat(filepath.Join(dir, binary)); err == nil && !c.exec.IsDir(info) {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Controller) probeLocalhostPath() error {
+	localhostPath := c.config.LocalHostConfig.LocalhostPath
+	if localhostPath == "" {
+		return newProbeError(csi.Error_ProbeNodeError_BAD_PLUGIN_CONFIG, "the localhost backend is enabled without a localhostPath")
+	}
+	info, err := c.exec.Stat(localhostPath)
+	if err != nil {
+		return newProbeError(csi.Error_ProbeNodeError_BAD_PLUGIN_CONFIG, "localhostPath %s is not accessible: %s", localhostPath, err.Error())
+	}
+	if !c.exec.IsDir(info) {
+		return newProbeError(csi.Error_ProbeNodeError_BAD_PLUGIN_CONFIG, "localhostPath %s is not a directory", localhostPath)
+	}
+	probeDir := filepath.Join(localhostPath, localhostProbeDir)
+	if err := c.exec.Mkdir(probeDir, 0700); err != nil && !os.IsExist(err) {
+		return newProbeError(csi.Error_ProbeNodeError_BAD_PLUGIN_CONFIG, "localhostPath %s is not writable: %s", localhostPath, err.Error())
+	}
+	if err := c.exec.Remove(probeDir); err != nil {
+		return newProbeError(csi.Error_ProbeNodeError_BAD_PLUGIN_CONFIG, "localhostPath %s is not writable: %s", localhostPath, err.Error())
+	}
+	return nil
+}
+
+func (c *Controller) probeUbiquityServer(ctx context.Context) error {
+	server := c.config.UbiquityServer
+	if server.Address == "" || server.Port == 0 {
+		return newProbeError(csi.Error_ProbeNodeError_BAD_PLUGIN_CONFIG, "missing ubiquity server address")
+	}
+	address := net.JoinHostPort(server.Address, fmt.Sprintf("%d", server.Port))
+	dialer := net.Dialer{Timeout: ubiquityServerProbeTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if err != nil {
+		return newProbeError(csi.Error_ProbeNodeError_MISSING_REQUIRED_HOST_DEPENDENCY, "ubiquity server %s does not answer: %s", address, err.Error())
+	}
+	conn.Close()
+	return nil
+}
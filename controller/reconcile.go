@@ -0,0 +1,280 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/midoblgsm/ubiquity/resources"
+	"golang.org/x/net/context"
+)
+
+// mountInfoPath is the kernel mount table of the plugin mount namespace
+const mountInfoPath = "/proc/self/mountinfo"
+
+//ReconcileReport lists the differences found between the node mounts and the ubiquity attachments
+type ReconcileReport struct {
+	Time time.Time
+	Host string
+	// StaleMounts are targets and staging mounts of volumes that are not attached to the node
+	StaleMounts []string
+	// OrphanedStagingDirs are staging directories without a mount nor a published target
+	OrphanedStagingDirs []string
+	// DanglingAttachments are volumes attached to the node without any mount on it
+	DanglingAttachments []string
+	// Cleaned tells whether the differences were cleaned up
+	Cleaned bool
+	Errors  []string
+}
+
+// reconcileState keeps the last report for the admin endpoint
+type reconcileState struct {
+	sync.Mutex
+	last *ReconcileReport
+}
+
+// readMountPoints returns the mount points of the kernel mount table, the fifth
+// field of each mountinfo line with the octal escapes of blanks decoded
+func (c *Controller) readMountPoints() (map[string]bool, error) {
+	out, err := c.exec.Execute("cat", []string{mountInfoPath})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %s", mountInfoPath, err.Error())
+	}
+	mountPoints := make(map[string]bool)
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 5 {
+			continue
+		}
+		mountPoints[unescapeMountInfo(fields[4])] = true
+	}
+	return mountPoints, nil
+}
+
+func unescapeMountInfo(field string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+3 < len(field) {
+			if v, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(v))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(field[i])
+	}
+	return b.String()
+}
+
+// reconcileTimeout bounds the ubiquity calls of a reconciliation
+const reconcileTimeout = 2 * time.Minute
+
+// attachedVolumes returns the volumes ubiquity reports as attached to the host, decided per
+// backend as getVolumeAttachment does: the mountpoint backends (localhost, spectrum-scale) are
+// attached while they report a mountpoint and the block backends (scbe) to the host in their
+// config, which is only looked up for them
+func (c *Controller) attachedVolumes(ctx context.Context, host string) (map[string]bool, error) {
+	var listVolumesResponse resources.ListVolumesResponse
+	if err := c.callUbiquity(ctx, "", "reconcile", func() {
+		listVolumesResponse = c.Client.ListVolumes(resources.ListVolumesRequest{})
+	}); err != nil {
+		return nil, err
+	}
+	if listVolumesResponse.Error != nil {
+		return nil, listVolumesResponse.Error
+	}
+	attached := make(map[string]bool)
+	for _, volume := range listVolumesResponse.Volumes {
+		if volume.Mountpoint == "" && !backendCapabilitiesTable[volume.Backend].block {
+			continue
+		}
+		attachment, err := c.getVolumeAttachment(ctx, volume, "reconcile")
+		if err != nil {
+			return nil, err
+		}
+		if attachment != "" && (volume.Mountpoint != "" || attachment == host) {
+			attached[volume.Name] = true
+		}
+	}
+	return attached, nil
+}
+
+//Reconcile compares the kernel mount table and the publish journal with the volumes ubiquity
+//reports as attached to the node, the differences are cleaned up when ReconcileCleanup is set
+func (c *Controller) Reconcile(ctx context.Context) (*ReconcileReport, error) {
+	c.logger.Printf("Entering-controller-reconcile")
+	defer c.logger.Printf("Exiting-controller-reconcile")
+	nodeID, err := c.buildNodeID()
+	if err != nil {
+		return nil, err
+	}
+	host, err := c.resolveNodeHost(nodeID)
+	if err != nil {
+		return nil, err
+	}
+	mountPoints, err := c.readMountPoints()
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithTimeout(ctx, reconcileTimeout)
+	defer cancel()
+	attached, err := c.attachedVolumes(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	report := &ReconcileReport{Time: time.Now(), Host: host, StaleMounts: []string{}, OrphanedStagingDirs: []string{}, DanglingAttachments: []string{}, Errors: []string{}}
+	mountedVolumes := make(map[string]bool)
+	journaled := make(map[string]bool)
+	for _, entry := range c.journal.list() {
+		journaled[entry.VolumeID] = true
+		if !mountPoints[entry.TargetPath] {
+			continue
+		}
+		mountedVolumes[entry.VolumeID] = true
+		if !attached[entry.VolumeID] {
+			report.StaleMounts = append(report.StaleMounts, entry.TargetPath)
+		}
+	}
+	stagingDirs, err := c.exec.GetGlobFiles(c.stagingPath("*"))
+	if err != nil {
+		return nil, err
+	}
+	for _, stagingDir := range stagingDirs {
+		volumeID := filepath.Base(stagingDir)
+		switch {
+		case mountPoints[stagingDir]:
+			mountedVolumes[volumeID] = true
+			if !attached[volumeID] {
+				report.StaleMounts = append(report.StaleMounts, stagingDir)
+			}
+		case !journaled[volumeID]:
+			report.OrphanedStagingDirs = append(report.OrphanedStagingDirs, stagingDir)
+		}
+	}
+	for volumeID := range attached {
+		if !mountedVolumes[volumeID] {
+			report.DanglingAttachments = append(report.DanglingAttachments, volumeID)
+		}
+	}
+	sort.Strings(report.StaleMounts)
+	sort.Strings(report.DanglingAttachments)
+
+	if c.config.CsiConfig.ReconcileCleanup {
+		c.cleanup(ctx, report)
+	}
+	c.logger.Printf("reconcile-report-%#v", report)
+	c.reconcileState.Lock()
+	c.reconcileState.last = report
+	c.reconcileState.Unlock()
+	return report, nil
+}
+
+// cleanup unmounts the stale mounts, removes the orphaned staging directories and
+// detaches the dangling attachments, the failures and the volumes skipped because
+// an operation is pending on them are recorded in the report
+func (c *Controller) cleanup(ctx context.Context, report *ReconcileReport) {
+	// the targets are released before the staging mounts they reference
+	targets, stagingPaths := []string{}, []string{}
+	for _, mountPoint := range report.StaleMounts {
+		if _, ok := c.journal.get(mountPoint); ok {
+			targets = append(targets, mountPoint)
+		} else {
+			stagingPaths = append(stagingPaths, mountPoint)
+		}
+	}
+	for _, mountPoint := range append(targets, stagingPaths...) {
+		volumeID := filepath.Base(mountPoint)
+		if entry, ok := c.journal.get(mountPoint); ok {
+			volumeID = entry.VolumeID
+		}
+		if !c.volumeLocks.tryLock(volumeID) {
+			report.Errors = append(report.Errors, operationPendingMessage(volumeID))
+			continue
+		}
+		c.cleanupStaleMount(report, volumeID, mountPoint)
+		c.volumeLocks.unlock(volumeID)
+	}
+	for _, stagingDir := range report.OrphanedStagingDirs {
+		if err := c.exec.Remove(stagingDir); err != nil && !c.exec.IsNotExist(err) {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to remove %s: %s", stagingDir, err.Error()))
+		}
+	}
+	for _, volumeID := range report.DanglingAttachments {
+		if !c.volumeLocks.tryLock(volumeID) {
+			report.Errors = append(report.Errors, operationPendingMessage(volumeID))
+			continue
+		}
+		var detachResponse resources.DetachResponse
+		err := c.callUbiquity(ctx, volumeID, "reconcile", func() {
+			detachResponse = c.Client.Detach(resources.DetachRequest{Name: volumeID, Host: report.Host})
+		})
+		c.volumeLocks.unlock(volumeID)
+		if err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to detach %s: %s", volumeID, err.Error()))
+		} else if detachResponse.Error != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to detach %s: %s", volumeID, detachResponse.Error.Error()))
+		}
+	}
+	report.Cleaned = true
+}
+
+// cleanupStaleMount unmounts a stale target and forgets it, or a stale staging mount
+// once none of the targets of the volume reference it any more
+func (c *Controller) cleanupStaleMount(report *ReconcileReport, volumeID string, mountPoint string) {
+	_, isTarget := c.journal.get(mountPoint)
+	if refs := c.stagingRefs.count(volumeID); !isTarget && refs > 0 {
+		report.Errors = append(report.Errors, fmt.Sprintf("staging path %s is still referenced by %d targets", mountPoint, refs))
+		return
+	}
+	if out, err := c.exec.Execute("umount", []string{mountPoint}); err != nil {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to unmount %s: %s: %s", mountPoint, err.Error(), string(out)))
+		return
+	}
+	if err := c.exec.Remove(mountPoint); err != nil && !c.exec.IsNotExist(err) {
+		report.Errors = append(report.Errors, fmt.Sprintf("failed to remove %s: %s", mountPoint, err.Error()))
+	}
+	if isTarget {
+		c.stagingRefs.remove(volumeID, mountPoint)
+		if err := c.journal.delete(mountPoint); err != nil {
+			report.Errors = append(report.Errors, fmt.Sprintf("failed to forget %s: %s", mountPoint, err.Error()))
+		}
+	}
+}
+
+//AdminHandler serves the reports of the node: GET /reconcile returns the last reconciliation report
+//and GET /interrupted lists the interrupted operations not retried yet, nothing can be changed through it
+func (c *Controller) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/reconcile", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		c.reconcileState.Lock()
+		report := c.reconcileState.last
+		c.reconcileState.Unlock()
+		if report == nil {
+			http.Error(w, "no reconciliation ran yet", http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+	})
+	mux.HandleFunc("/interrupted", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(c.InterruptedOperations())
+	})
+	return mux
+}
@@ -0,0 +1,171 @@
+package controller
+
+import (
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	csi_utils "github.com/midoblgsm/ubiquity-csi/utils"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// The functions below translate the errors returned by the controller into typed csi error replies.
+// Only transport failures, a cancelled or timed out call, are returned as grpc status errors.
+
+// transportError returns the grpc status error to return for a transport failure, nil otherwise
+func transportError(err error) error {
+	switch err {
+	case context.Canceled:
+		return status.Error(codes.Canceled, err.Error())
+	case context.DeadlineExceeded:
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	if _, ok := err.(interface {
+		GRPCStatus() *status.Status
+	}); ok {
+		return err
+	}
+	return nil
+}
+
+//CreateVolumeErrorReply translates a CreateVolume failure
+func CreateVolumeErrorReply(err error) (*csi.CreateVolumeResponse, error) {
+	if tErr := transportError(err); tErr != nil {
+		return nil, tErr
+	}
+	return csi_utils.ErrCreateVolume(csi.Error_CreateVolumeError_UNKNOWN, err.Error()), nil
+}
+
+//DeleteVolumeErrorReply translates a DeleteVolume failure
+func DeleteVolumeErrorReply(err error) (*csi.DeleteVolumeResponse, error) {
+	if tErr := transportError(err); tErr != nil {
+		return nil, tErr
+	}
+	code := csi.Error_DeleteVolumeError_UNKNOWN
+	if isNotFoundError(err) {
+		code = csi.Error_DeleteVolumeError_VOLUME_DOES_NOT_EXIST
+	} else if isNotAuthorizedError(err) {
+		code = csi.Error_DeleteVolumeError_CALLER_NOT_AUTHORIZED
+	}
+	return csi_utils.ErrDeleteVolume(code, err.Error()), nil
+}
+
+//ControllerPublishVolumeErrorReply translates a ControllerPublishVolume failure
+func ControllerPublishVolumeErrorReply(err error) (*csi.ControllerPublishVolumeResponse, error) {
+	if tErr := transportError(err); tErr != nil {
+		return nil, tErr
+	}
+	code, ok := attachErrorCode(err)
+	if !ok {
+		code = csi.Error_ControllerPublishVolumeError_UNKNOWN
+	}
+	return csi_utils.ErrControllerPublishVolume(code, err.Error()), nil
+}
+
+//ControllerUnpublishVolumeErrorReply translates a ControllerUnpublishVolume failure
+func ControllerUnpublishVolumeErrorReply(err error) (*csi.ControllerUnpublishVolumeResponse, error) {
+	if tErr := transportError(err); tErr != nil {
+		return nil, tErr
+	}
+	code, _ := detachErrorCode(err)
+	return csi_utils.ErrControllerUnpublishVolume(code, err.Error()), nil
+}
+
+//ValidateVolumeCapabilitiesErrorReply translates a ValidateVolumeCapabilities failure
+func ValidateVolumeCapabilitiesErrorReply(err error) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if tErr := transportError(err); tErr != nil {
+		return nil, tErr
+	}
+	code := csi.Error_ValidateVolumeCapabilitiesError_UNKNOWN
+	if isNotFoundError(err) {
+		code = csi.Error_ValidateVolumeCapabilitiesError_VOLUME_DOES_NOT_EXIST
+	}
+	return csi_utils.ErrValidateVolumeCapabilities(code, err.Error()), nil
+}
+
+//ListVolumesErrorReply translates a ListVolumes failure
+func ListVolumesErrorReply(err error) (*csi.ListVolumesResponse, error) {
+	if tErr := transportError(err); tErr != nil {
+		return nil, tErr
+	}
+	return csi_utils.ErrListVolumes(csi.Error_GeneralError_UNDEFINED, err.Error()), nil
+}
+
+//GetCapacityErrorReply translates a GetCapacity failure
+func GetCapacityErrorReply(err error) (*csi.GetCapacityResponse, error) {
+	if tErr := transportError(err); tErr != nil {
+		return nil, tErr
+	}
+	return csi_utils.ErrGetCapacity(csi.Error_GeneralError_UNDEFINED, err.Error()), nil
+}
+
+//ControllerGetCapabilitiesErrorReply translates a ControllerGetCapabilities failure
+func ControllerGetCapabilitiesErrorReply(err error) (*csi.ControllerGetCapabilitiesResponse, error) {
+	if tErr := transportError(err); tErr != nil {
+		return nil, tErr
+	}
+	return csi_utils.ErrControllerGetCapabilities(csi.Error_GeneralError_UNDEFINED, err.Error()), nil
+}
+
+//GetSupportedVersionsErrorReply translates a GetSupportedVersions failure
+func GetSupportedVersionsErrorReply(err error) (*csi.GetSupportedVersionsResponse, error) {
+	if tErr := transportError(err); tErr != nil {
+		return nil, tErr
+	}
+	return csi_utils.ErrGetSupportedVersions(csi.Error_GeneralError_UNDEFINED, err.Error()), nil
+}
+
+//GetPluginInfoErrorReply translates a GetPluginInfo failure
+func GetPluginInfoErrorReply(err error) (*csi.GetPluginInfoResponse, error) {
+	if tErr := transportError(err); tErr != nil {
+		return nil, tErr
+	}
+	return csi_utils.ErrGetPluginInfo(csi.Error_GeneralError_UNDEFINED, err.Error()), nil
+}
+
+//NodePublishVolumeErrorReply translates a NodePublishVolume failure
+func NodePublishVolumeErrorReply(err error) (*csi.NodePublishVolumeResponse, error) {
+	if tErr := transportError(err); tErr != nil {
+		return nil, tErr
+	}
+	code := csi.Error_NodePublishVolumeError_MOUNT_ERROR
+	if isNotFoundError(err) {
+		code = csi.Error_NodePublishVolumeError_VOLUME_DOES_NOT_EXIST
+	}
+	return csi_utils.ErrNodePublishVolume(code, err.Error()), nil
+}
+
+//NodeUnpublishVolumeErrorReply translates a NodeUnpublishVolume failure
+func NodeUnpublishVolumeErrorReply(err error) (*csi.NodeUnpublishVolumeResponse, error) {
+	if tErr := transportError(err); tErr != nil {
+		return nil, tErr
+	}
+	code := csi.Error_NodeUnpublishVolumeError_UNMOUNT_ERROR
+	if isNotFoundError(err) {
+		code = csi.Error_NodeUnpublishVolumeError_VOLUME_DOES_NOT_EXIST
+	}
+	return csi_utils.ErrNodeUnpublishVolume(code, err.Error()), nil
+}
+
+//GetNodeIDErrorReply translates a GetNodeID failure
+func GetNodeIDErrorReply(err error) (*csi.GetNodeIDResponse, error) {
+	if tErr := transportError(err); tErr != nil {
+		return nil, tErr
+	}
+	return csi_utils.ErrGetNodeID(csi.Error_GetNodeIDError_UNKNOWN, err.Error()), nil
+}
+
+//ProbeNodeErrorReply translates a ProbeNode failure
+func ProbeNodeErrorReply(err error) (*csi.ProbeNodeResponse, error) {
+	if tErr := transportError(err); tErr != nil {
+		return nil, tErr
+	}
+	return csi_utils.ErrProbeNode(csi.Error_ProbeNodeError_UNKNOWN, err.Error()), nil
+}
+
+//NodeGetCapabilitiesErrorReply translates a NodeGetCapabilities failure
+func NodeGetCapabilitiesErrorReply(err error) (*csi.NodeGetCapabilitiesResponse, error) {
+	if tErr := transportError(err); tErr != nil {
+		return nil, tErr
+	}
+	return csi_utils.ErrNodeGetCapabilities(csi.Error_GeneralError_UNDEFINED, err.Error()), nil
+}
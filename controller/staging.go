@@ -0,0 +1,160 @@
+package controller
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/midoblgsm/ubiquity/resources"
+	"golang.org/x/net/context"
+)
+
+// defaultStagingPath is the plugin-owned directory holding the global mount of every published volume
+const defaultStagingPath = "/var/lib/ubiquity-csi/staging"
+
+// stagingRefs counts the targets of every staged volume, the staging mount and the
+// ubiquity attachment of a volume are released with its last target
+type stagingRefs struct {
+	sync.Mutex
+	targets map[string]map[string]bool
+}
+
+func newStagingRefs() *stagingRefs {
+	return &stagingRefs{targets: make(map[string]map[string]bool)}
+}
+
+func (r *stagingRefs) add(volumeID string, targetPath string) {
+	r.Lock()
+	defer r.Unlock()
+	if r.targets[volumeID] == nil {
+		r.targets[volumeID] = make(map[string]bool)
+	}
+	r.targets[volumeID][targetPath] = true
+}
+
+// isLast tells whether the target is the only one left for the volume
+func (r *stagingRefs) isLast(volumeID string, targetPath string) bool {
+	r.Lock()
+	defer r.Unlock()
+	targets := r.targets[volumeID]
+	return len(targets) == 1 && targets[targetPath]
+}
+
+// count returns the number of targets of the volume
+func (r *stagingRefs) count(volumeID string) int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.targets[volumeID])
+}
+
+func (r *stagingRefs) remove(volumeID string, targetPath string) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.targets[volumeID], targetPath)
+	if len(r.targets[volumeID]) == 0 {
+		delete(r.targets, volumeID)
+	}
+}
+
+func (c *Controller) stagingPath(volumeID string) string {
+	stagingPath := c.config.CsiConfig.StagingPath
+	if stagingPath == "" {
+		stagingPath = defaultStagingPath
+	}
+	return filepath.Join(stagingPath, volumeID)
+}
+
+// stageVolume mounts the volume once under the staging directory and returns the staging path,
+// the device is mounted with the mount flags when ubiquity attached it without a mountpoint.
+// The file system options of a volume ubiquity mounted itself cannot be changed, and the
+// staging mount keeps the options of the first publish of the volume on the node
+func (c *Controller) stageVolume(volumeID string, mountpoint string, mountpointInfo os.FileInfo, device string, fsType string, flags []string) (string, error) {
+	stagingPath := c.stagingPath(volumeID)
+	staged, err := c.isMounted(stagingPath)
+	if err != nil {
+		return "", err
+	}
+	if staged {
+		return stagingPath, nil
+	}
+	if err := c.exec.MkdirAll(stagingPath, targetPathPerm); err != nil {
+		return "", fmt.Errorf("failed to create staging path %s: %s", stagingPath, err.Error())
+	}
+	if mountpointInfo.Mode()&os.ModeDevice != 0 {
+		err = c.mountDevice(device, fsType, stagingPath, false, flags)
+	} else {
+		if len(flags) > len(perMountFlags(flags)) {
+			c.logger.Printf("file-system-options-%v-of-volume-%s-mounted-by-ubiquity-are-not-applied", flags, volumeID)
+		}
+		err = c.bindMount(mountpoint, stagingPath, false, nil)
+	}
+	if err != nil {
+		return "", err
+	}
+	c.logger.Printf("staged-volume-%s-on-%s", volumeID, stagingPath)
+	return stagingPath, nil
+}
+
+// releaseTarget forgets the target of the volume, the volume is unstaged and detached
+// from the node with its last target, the target is kept when the release fails so that
+// a retry of the unpublish releases the volume
+func (c *Controller) releaseTarget(ctx context.Context, volumeID string, targetPath string) error {
+	if c.stagingRefs.isLast(volumeID, targetPath) {
+		if err := c.unstageVolume(ctx, volumeID); err != nil {
+			return err
+		}
+	}
+	c.stagingRefs.remove(volumeID, targetPath)
+	return nil
+}
+
+func (c *Controller) unstageVolume(ctx context.Context, volumeID string) error {
+	if err := c.checkContext(ctx, volumeID, "unpublish"); err != nil {
+		return err
+	}
+	if err := c.unmountStaging(volumeID); err != nil {
+		return err
+	}
+	if entry, ok := c.journal.blockEntry(volumeID); ok {
+		if err := c.restoreUbiquityMount(entry); err != nil {
+			return err
+		}
+	}
+	nodeID, err := c.buildNodeID()
+	if err != nil {
+		return err
+	}
+	hostname, err := c.resolveNodeHost(nodeID)
+	if err != nil {
+		return err
+	}
+	var detachResponse resources.DetachResponse
+	if err := c.callUbiquity(ctx, volumeID, "unpublish", func() {
+		detachResponse = c.Client.Detach(resources.DetachRequest{Name: volumeID, Host: hostname})
+	}); err != nil {
+		return err
+	}
+	if detachResponse.Error != nil && !errorContainsAny(detachResponse.Error, notAttachedErrorMessages) {
+		return fmt.Errorf("failed to detach volume %s from %s: %s", volumeID, hostname, detachResponse.Error.Error())
+	}
+	c.logger.Printf("unstaged-volume-%s", volumeID)
+	return nil
+}
+
+func (c *Controller) unmountStaging(volumeID string) error {
+	stagingPath := c.stagingPath(volumeID)
+	staged, err := c.isMounted(stagingPath)
+	if err != nil {
+		return err
+	}
+	if staged {
+		if out, err := c.exec.Execute("umount", []string{stagingPath}); err != nil {
+			return fmt.Errorf("failed to unmount staging path %s: %s: %s", stagingPath, err.Error(), string(out))
+		}
+	}
+	if err := c.exec.Remove(stagingPath); err != nil && !c.exec.IsNotExist(err) {
+		return fmt.Errorf("failed to remove staging path %s: %s", stagingPath, err.Error())
+	}
+	return nil
+}
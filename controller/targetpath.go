@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+// validateTargetPath returns the clean form of a target path given by the CO, a target must
+// be absolute, without .. components and, when a target root is configured, under the root
+// once its existing components are resolved so that a symlink cannot lead the mount elsewhere
+func (c *Controller) validateTargetPath(targetPath string) (string, error) {
+	if !filepath.IsAbs(targetPath) {
+		return "", fmt.Errorf("target path %s is not absolute", targetPath)
+	}
+	for _, component := range strings.Split(targetPath, "/") {
+		if component == ".." {
+			return "", fmt.Errorf("target path %s contains a .. component", targetPath)
+		}
+	}
+	targetPath = filepath.Clean(targetPath)
+	root := c.config.CsiConfig.TargetRoot
+	if root == "" {
+		return targetPath, nil
+	}
+	root = filepath.Clean(root)
+	if !isUnder(targetPath, root) {
+		return "", fmt.Errorf("target path %s is not under the target root %s", targetPath, root)
+	}
+	resolvedRoot, err := c.exec.EvalSymlinks(root)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve the target root %s: %s", root, err.Error())
+	}
+	resolved, err := c.resolveExistingPath(targetPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve target path %s: %s", targetPath, err.Error())
+	}
+	if !isUnder(resolved, resolvedRoot) {
+		return "", fmt.Errorf("target path %s resolves to %s which is not under the target root %s", targetPath, resolved, root)
+	}
+	return targetPath, nil
+}
+
+// resolveExistingPath resolves the symlinks of the longest existing prefix of the path and
+// appends the missing components, a dangling symlink is not a missing component: readlink
+// succeeds on the link itself when the file it points to does not exist
+func (c *Controller) resolveExistingPath(path string) (string, error) {
+	missing := ""
+	for {
+		resolved, err := c.exec.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, missing), nil
+		}
+		if !c.exec.IsNotExist(err) {
+			return "", err
+		}
+		if _, lerr := c.exec.Execute("readlink", []string{path}); lerr == nil {
+			return "", fmt.Errorf("%s is a dangling symlink", path)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return "", err
+		}
+		missing = filepath.Join(filepath.Base(path), missing)
+		path = parent
+	}
+}
+
+// isUnder tells whether the path is strictly under the root
+func isUnder(path string, root string) bool {
+	rel, err := filepath.Rel(root, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, "../")
+}
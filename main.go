@@ -7,8 +7,12 @@ import (
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/BurntSushi/toml"
 	"github.com/midoblgsm/ubiquity-csi/controller"
@@ -16,12 +20,12 @@ import (
 
 	"golang.org/x/net/context"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials"
 
 	"flag"
 	"path"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
-	"github.com/midoblgsm/ubiquity/resources"
 	"github.com/midoblgsm/ubiquity/utils"
 	"github.com/midoblgsm/ubiquity/utils/logs"
 )
@@ -36,22 +40,39 @@ var configFile = flag.String(
 	"config file with ubiquity client configuration params",
 )
 
+// exit statuses of the plugin
+const (
+	exitOK = iota
+	exitError
+	// exitShutdownTimeout is returned when operations were still in flight at the end of the shutdown timeout
+	exitShutdownTimeout
+)
+
+// defaultShutdownTimeout bounds the wait for the in-flight operations when none is configured
+const defaultShutdownTimeout = 30 * time.Second
+
 func main() {
+	os.Exit(run())
+}
+
+// run serves the plugin until it fails or is stopped by SIGTERM or SIGINT, it returns
+// once the logs are closed so that the exit status is the last thing left to do
+func run() int {
 	l, err := csi_utils.GetCSIEndpointListener()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: failed to listen: %v\n", err)
-		os.Exit(1)
+		return exitError
 	}
 
 	ctx := context.Background()
 
 	//init the controller
 	flag.Parse()
-	var config resources.UbiquityPluginConfig
+	var config controller.Config
 	fmt.Printf("Starting ubiquity plugin with %s config file\n", *configFile)
 	if _, err := toml.DecodeFile(*configFile, &config); err != nil {
 		fmt.Println(err)
-		return
+		return exitError
 	}
 
 	defer logs.InitFileLogger(logs.DEBUG, path.Join(config.LogPath, "ubiquity-csi.log"))()
@@ -62,13 +83,75 @@ func main() {
 	controller, err := controller.NewController(logger, "ubiquity", storageAPIURL, config)
 	if err != nil {
 		logger.Printf("error-creating-controller %#v\n", err)
-		panic(fmt.Sprintf("error-creating-controller", err))
+		panic(fmt.Sprintf("error-creating-controller %v", err))
 	}
 	s := &sp{controller: controller}
-	if err := s.Serve(ctx, l); err != nil {
+	shutdownTimeout := time.Duration(config.CsiConfig.ShutdownTimeout) * time.Second
+	if shutdownTimeout == 0 {
+		shutdownTimeout = defaultShutdownTimeout
+	}
+	// the signals are handled before the startup work, which a stop cancels
+	startup, stopStartup := context.WithCancel(ctx)
+	defer stopStartup()
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
+	stopped := handleSignals(signals, s, shutdownTimeout, logger, stopStartup, func(status int) {
+		csi_utils.RemoveCSIEndpointSocket()
+		os.Exit(status)
+	})
+
+	if err := controller.RecoverPublishState(startup); err != nil {
+		logger.Printf("error-recovering-publish-state %#v\n", err)
+	}
+	if _, err := controller.Reconcile(startup); err != nil {
+		logger.Printf("error-reconciling-node %#v\n", err)
+	}
+	if config.CsiConfig.AdminAddress != "" && startup.Err() == nil {
+		go func() {
+			logger.Printf("error-serving-admin-endpoint %#v\n", http.ListenAndServe(config.CsiConfig.AdminAddress, controller.AdminHandler()))
+		}()
+	}
+	if tlsConfig := config.CsiConfig.TLS; tlsConfig.CertFile != "" {
+		serverTLS, err := csi_utils.NewServerTLSConfig(tlsConfig.CertFile, tlsConfig.KeyFile, tlsConfig.ClientCAFile, tlsConfig.RequireClientCert)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: failed to configure tls: %v\n", err)
+			logger.Printf("error-configuring-tls %#v\n", err)
+			return exitError
+		}
+		s.serverOptions = append(s.serverOptions, grpc.Creds(credentials.NewTLS(serverTLS)))
+	}
+
+	// a server stopped during the startup does not serve
+	if err := s.Serve(ctx, l); err != nil && err != errServerStopped {
 		fmt.Fprintf(os.Stderr, "error: grpc failed: %v\n", err)
-		os.Exit(1)
+		logger.Printf("error-serving-grpc %#v\n", err)
+		return exitError
+	}
+	status := <-stopped
+	if err := csi_utils.RemoveCSIEndpointSocket(); err != nil {
+		logger.Printf("error-removing-endpoint-socket %#v\n", err)
 	}
+	logger.Printf("stopped-with-status-%d\n", status)
+	return status
+}
+
+// handleSignals cancels the startup work and shuts the server down on the first signal and sends
+// the exit status on the returned channel, a second signal exits at once instead of waiting out
+// the shutdown timeout
+func handleSignals(signals <-chan os.Signal, s *sp, timeout time.Duration, logger *log.Logger, stopStartup func(), exit func(int)) <-chan int {
+	stopped := make(chan int, 1)
+	go func() {
+		sig := <-signals
+		logger.Printf("received-signal-%s-stopping-within-%s\n", sig, timeout)
+		stopStartup()
+		go func() {
+			stopped <- s.shutdown(timeout)
+		}()
+		sig = <-signals
+		logger.Printf("received-second-signal-%s-exiting-now\n", sig)
+		exit(exitShutdownTimeout)
+	}()
+	return stopped
 }
 
 ////////////////////////////////////////////////////////////////////////////////
@@ -88,12 +171,15 @@ var ServiceProviders = map[string]func() interface{}{
 	name: func() interface{} { return &sp{name: name} },
 }
 
+// sp serves the csi services, its mutex only guards the server state, the
+// controller serializes the operations of every volume on its own
 type sp struct {
 	sync.Mutex
-	name       string
-	server     *grpc.Server
-	closed     bool
-	controller *controller.Controller
+	name          string
+	server        *grpc.Server
+	serverOptions []grpc.ServerOption
+	closed        bool
+	controller    *controller.Controller
 }
 
 // ServiceProvider.Serve
@@ -108,17 +194,17 @@ func (s *sp) Serve(ctx context.Context, li net.Listener) error {
 		if s.server != nil {
 			return errServerStarted
 		}
-		s.server = grpc.NewServer()
+		s.server = grpc.NewServer(s.serverOptions...)
 		return nil
 	}(); err != nil {
-		return errServerStarted
+		return err
 	}
 	csi.RegisterControllerServer(s.server, s)
 	csi.RegisterIdentityServer(s.server, s)
 	csi.RegisterNodeServer(s.server, s)
 
 	// start the grpc server
-	if err := s.server.Serve(li); err != grpc.ErrServerStopped {
+	if err := s.server.Serve(li); err != nil && err != grpc.ErrServerStopped {
 		return err
 	}
 	return errServerStopped
@@ -152,18 +238,56 @@ func (s *sp) GracefulStop(ctx context.Context) {
 	s.closed = true
 }
 
+// shutdown stops accepting RPCs and waits for the in-flight operations up to the timeout,
+// the operations still running at the end of the timeout are cut off, a server that is
+// not serving yet is closed so that it never starts
+func (s *sp) shutdown(timeout time.Duration) int {
+	s.Lock()
+	server := s.server
+	if s.closed || server == nil {
+		s.closed = true
+		s.Unlock()
+		// the ubiquity calls of a cancelled startup may still be running
+		if s.controller != nil && !s.controller.WaitForOperations(timeout) {
+			log.Println(name + ".shutdown: in-flight ubiquity calls cut off")
+			return exitShutdownTimeout
+		}
+		return exitOK
+	}
+	s.server = nil
+	s.closed = true
+	s.Unlock()
+
+	deadline := time.Now().Add(timeout)
+	drained := make(chan struct{})
+	go func() {
+		server.GracefulStop()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(timeout):
+		log.Println(name + ".shutdown: in-flight RPCs cut off")
+		server.Stop()
+		return exitShutdownTimeout
+	}
+	// the ubiquity calls abandoned by cancelled RPCs may still be running
+	if !s.controller.WaitForOperations(time.Until(deadline)) {
+		log.Println(name + ".shutdown: in-flight ubiquity calls cut off")
+		return exitShutdownTimeout
+	}
+	return exitOK
+}
+
 ////////////////////////////////////////////////////////////////////////////////
 //                            Controller Service                              //
 ////////////////////////////////////////////////////////////////////////////////
 
 func (s *sp) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
 
-	s.Lock()
-	defer s.Unlock()
-
-	createVolumeResponse, err := s.controller.CreateVolume(*req)
+	createVolumeResponse, err := s.controller.CreateVolume(ctx, *req)
 	if err != nil {
-		return nil, err
+		return controller.CreateVolumeErrorReply(err)
 	}
 
 	return &createVolumeResponse, nil
@@ -174,14 +298,10 @@ func (s *sp) DeleteVolume(
 	req *csi.DeleteVolumeRequest) (
 	*csi.DeleteVolumeResponse, error) {
 
-	s.Lock()
-	defer s.Unlock()
-
-	response, err := s.controller.DeleteVolume(*req)
+	response, err := s.controller.DeleteVolume(ctx, *req)
 
 	if err != nil {
-		// UNDEFINED
-		return nil, err
+		return controller.DeleteVolumeErrorReply(err)
 	}
 
 	return &response, nil
@@ -192,13 +312,9 @@ func (s *sp) ControllerPublishVolume(
 	req *csi.ControllerPublishVolumeRequest) (
 	*csi.ControllerPublishVolumeResponse, error) {
 
-	s.Lock()
-	defer s.Unlock()
-
-	response, err := s.controller.Attach(*req)
+	response, err := s.controller.Attach(ctx, *req)
 	if err != nil {
-		// UNDEFINED
-		return nil, err
+		return controller.ControllerPublishVolumeErrorReply(err)
 	}
 	return &response, nil
 }
@@ -208,13 +324,9 @@ func (s *sp) ControllerUnpublishVolume(
 	req *csi.ControllerUnpublishVolumeRequest) (
 	*csi.ControllerUnpublishVolumeResponse, error) {
 
-	s.Lock()
-	defer s.Unlock()
-
-	detachResponse, err := s.controller.Detach(*req)
+	detachResponse, err := s.controller.Detach(ctx, *req)
 	if err != nil {
-		// UNDEFINED
-		return nil, err
+		return controller.ControllerUnpublishVolumeErrorReply(err)
 	}
 	return &detachResponse, nil
 }
@@ -223,9 +335,9 @@ func (s *sp) ValidateVolumeCapabilities(
 	ctx context.Context,
 	req *csi.ValidateVolumeCapabilitiesRequest) (
 	*csi.ValidateVolumeCapabilitiesResponse, error) {
-	resp, err := s.controller.ValidateCapabilities(*req)
+	resp, err := s.controller.ValidateCapabilities(ctx, *req)
 	if err != nil {
-		return nil, err
+		return controller.ValidateVolumeCapabilitiesErrorReply(err)
 	}
 	return &resp, nil
 }
@@ -235,13 +347,9 @@ func (s *sp) ListVolumes(
 	req *csi.ListVolumesRequest) (
 	*csi.ListVolumesResponse, error) {
 
-	s.Lock()
-	defer s.Unlock()
-
-	listResponse, err := s.controller.ListVolumes(*req)
+	listResponse, err := s.controller.ListVolumes(ctx, *req)
 	if err != nil {
-		// UNDEFINED
-		return nil, err
+		return controller.ListVolumesErrorReply(err)
 	}
 
 	return &listResponse, nil
@@ -252,10 +360,9 @@ func (s *sp) GetCapacity(
 	req *csi.GetCapacityRequest) (
 	*csi.GetCapacityResponse, error) {
 
-	response, err := s.controller.GetCapacity(*req)
+	response, err := s.controller.GetCapacity(ctx, *req)
 	if err != nil {
-		// UNDEFINED
-		return nil, err
+		return controller.GetCapacityErrorReply(err)
 	}
 	return &response, nil
 }
@@ -265,9 +372,9 @@ func (s *sp) ControllerGetCapabilities(
 	req *csi.ControllerGetCapabilitiesRequest) (
 	*csi.ControllerGetCapabilitiesResponse, error) {
 
-	response, err := s.controller.ControllerGetCapabilities(*req)
+	response, err := s.controller.ControllerGetCapabilities(ctx, *req)
 	if err != nil {
-		return nil, err
+		return controller.ControllerGetCapabilitiesErrorReply(err)
 	}
 	return &response, nil
 }
@@ -285,9 +392,9 @@ func (s *sp) GetSupportedVersions(
 	req *csi.GetSupportedVersionsRequest) (
 	*csi.GetSupportedVersionsResponse, error) {
 
-	response, err := s.controller.GetSupportedVersions(*req)
+	response, err := s.controller.GetSupportedVersions(ctx, *req)
 	if err != nil {
-		return nil, err
+		return controller.GetSupportedVersionsErrorReply(err)
 	}
 	return &response, nil
 }
@@ -297,9 +404,9 @@ func (s *sp) GetPluginInfo(
 	req *csi.GetPluginInfoRequest) (
 	*csi.GetPluginInfoResponse, error) {
 
-	response, err := s.controller.GetPluginInfos(*req)
+	response, err := s.controller.GetPluginInfos(ctx, *req)
 	if err != nil {
-		return nil, err
+		return controller.GetPluginInfoErrorReply(err)
 	}
 	return &response, nil
 }
@@ -321,12 +428,9 @@ func (s *sp) NodePublishVolume(
 	req *csi.NodePublishVolumeRequest) (
 	*csi.NodePublishVolumeResponse, error) {
 
-	s.Lock()
-	defer s.Unlock()
-
-	response, err := s.controller.Mount(*req)
+	response, err := s.controller.Mount(ctx, *req)
 	if err != nil {
-		return nil, err
+		return controller.NodePublishVolumeErrorReply(err)
 	}
 	return &response, nil
 }
@@ -336,11 +440,9 @@ func (s *sp) NodeUnpublishVolume(
 	req *csi.NodeUnpublishVolumeRequest) (
 	*csi.NodeUnpublishVolumeResponse, error) {
 
-	s.Lock()
-	defer s.Unlock()
-	response, err := s.controller.Unount(*req)
+	response, err := s.controller.Unount(ctx, *req)
 	if err != nil {
-		return nil, err
+		return controller.NodeUnpublishVolumeErrorReply(err)
 	}
 	return &response, nil
 }
@@ -350,9 +452,9 @@ func (s *sp) GetNodeID(
 	req *csi.GetNodeIDRequest) (
 	*csi.GetNodeIDResponse, error) {
 
-	response, err := s.controller.GetNodeID(*req)
+	response, err := s.controller.GetNodeID(ctx, *req)
 	if err != nil {
-		return nil, err
+		return controller.GetNodeIDErrorReply(err)
 	}
 	return &response, nil
 }
@@ -361,9 +463,9 @@ func (s *sp) ProbeNode(
 	ctx context.Context,
 	req *csi.ProbeNodeRequest) (
 	*csi.ProbeNodeResponse, error) {
-	response, err := s.controller.ProbeNode(*req)
+	response, err := s.controller.ProbeNode(ctx, *req)
 	if err != nil {
-		return nil, err
+		return controller.ProbeNodeErrorReply(err)
 	}
 	return &response, nil
 
@@ -374,9 +476,9 @@ func (s *sp) NodeGetCapabilities(
 	req *csi.NodeGetCapabilitiesRequest) (
 	*csi.NodeGetCapabilitiesResponse, error) {
 
-	response, err := s.controller.GetNodeCapabilities(*req)
+	response, err := s.controller.GetNodeCapabilities(ctx, *req)
 	if err != nil {
-		return nil, err
+		return controller.NodeGetCapabilitiesErrorReply(err)
 	}
 	return &response, nil
 }
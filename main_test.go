@@ -0,0 +1,112 @@
+package main
+
+import (
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	ctl "github.com/midoblgsm/ubiquity-csi/controller"
+	"github.com/midoblgsm/ubiquity/fakes"
+	"github.com/midoblgsm/ubiquity/resources"
+	"golang.org/x/net/context"
+)
+
+var _ = Describe("Main", func() {
+
+	var (
+		fakeClient *fakes.FakeStorageClient
+		s          *sp
+		listener   net.Listener
+		logger     *log.Logger
+		release    chan bool
+	)
+	BeforeEach(func() {
+		var err error
+		logger = log.New(GinkgoWriter, "ubiquity-csi: ", log.LstdFlags)
+		fakeClient = new(fakes.FakeStorageClient)
+		release = make(chan bool)
+		fakeClient.AttachStub = func(attachRequest resources.AttachRequest) resources.AttachResponse {
+			<-release
+			return resources.AttachResponse{Mountpoint: "/tmp/test/mnt2"}
+		}
+		s = &sp{controller: ctl.NewControllerWithClient(logger, fakeClient, new(fakes.FakeExecutor), ctl.Config{})}
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).ToNot(HaveOccurred())
+	})
+	AfterEach(func() {
+		close(release)
+		listener.Close()
+	})
+
+	// serve starts the server with an attach stuck in ubiquity and returns the result of Serve
+	serve := func() chan error {
+		served := make(chan error, 1)
+		go func() {
+			served <- s.Serve(context.Background(), listener)
+		}()
+		Eventually(func() bool {
+			s.Lock()
+			defer s.Unlock()
+			return s.server != nil
+		}).Should(BeTrue())
+		go s.ControllerPublishVolume(context.Background(), &csi.ControllerPublishVolumeRequest{
+			Version:      &csi.Version{},
+			VolumeHandle: &csi.VolumeHandle{Id: "testVolume"},
+			NodeId:       &csi.NodeID{Values: map[string]string{"hostname": "node1"}},
+		})
+		Eventually(fakeClient.AttachCallCount).Should(Equal(1))
+		return served
+	}
+
+	Context(".shutdown", func() {
+		It("Should keep a server stopped before it started from serving", func() {
+			Expect(s.shutdown(time.Second)).To(Equal(exitOK))
+			Expect(s.Serve(context.Background(), listener)).To(Equal(errServerStopped))
+		})
+		It("Should cut off the operations still in flight at the end of the timeout", func() {
+			served := serve()
+			start := time.Now()
+			Expect(s.shutdown(50 * time.Millisecond)).To(Equal(exitShutdownTimeout))
+			Expect(time.Since(start)).To(BeNumerically("<", time.Second))
+			Eventually(served).Should(Receive(Equal(errServerStopped)))
+		})
+		It("Should stop cleanly once the operations in flight complete", func() {
+			served := serve()
+			go func() {
+				time.Sleep(50 * time.Millisecond)
+				release <- true
+			}()
+			Expect(s.shutdown(5 * time.Second)).To(Equal(exitOK))
+			Eventually(served).Should(Receive(Equal(errServerStopped)))
+		})
+	})
+
+	Context(".handleSignals", func() {
+		It("Should exit at once on a second signal", func() {
+			serve()
+			signals := make(chan os.Signal, 2)
+			exited := make(chan int, 1)
+			stopped := handleSignals(signals, s, time.Minute, logger, func() {}, func(status int) { exited <- status })
+			signals <- syscall.SIGTERM
+			Consistently(exited, 100*time.Millisecond).ShouldNot(Receive())
+			signals <- syscall.SIGINT
+			Eventually(exited).Should(Receive(Equal(exitShutdownTimeout)))
+			Expect(stopped).ToNot(Receive())
+		})
+		It("Should cancel the startup work and keep the server from serving on a signal received during the startup", func() {
+			startup, stopStartup := context.WithCancel(context.Background())
+			signals := make(chan os.Signal, 2)
+			stopped := handleSignals(signals, s, time.Second, logger, stopStartup, func(int) {})
+			signals <- syscall.SIGTERM
+			Eventually(startup.Done()).Should(BeClosed())
+			Eventually(stopped).Should(Receive(Equal(exitOK)))
+			Expect(s.Serve(context.Background(), listener)).To(Equal(errServerStopped))
+		})
+	})
+})
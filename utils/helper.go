@@ -82,6 +82,57 @@ func CreateVolume(
 	return data, nil
 }
 
+// DeleteVolume issues a DeleteVolume request to a CSI controller.
+func DeleteVolume(
+	ctx context.Context,
+	c csi.ControllerClient,
+	version *csi.Version,
+	volumeID *csi.VolumeHandle,
+	callOpts ...grpc.CallOption) error {
+
+	if version == nil {
+		return ErrVersionRequired
+	}
+
+	if volumeID == nil {
+		return ErrVolumeIDRequired
+	}
+
+	req := &csi.DeleteVolumeRequest{
+		Version:      version,
+		VolumeHandle: volumeID,
+	}
+
+	res, err := c.DeleteVolume(ctx, req, callOpts...)
+	if err != nil {
+		return err
+	}
+
+	// check to see if there is a csi error
+	if cerr := res.GetError(); cerr != nil {
+		if err := cerr.GetDeleteVolumeError(); err != nil {
+			return fmt.Errorf(
+				"error: DeleteVolume failed: %d: %s",
+				err.GetErrorCode(),
+				err.GetErrorDescription())
+		}
+		if err := cerr.GetGeneralError(); err != nil {
+			return fmt.Errorf(
+				"error: DeleteVolume failed: %d: %s",
+				err.GetErrorCode(),
+				err.GetErrorDescription())
+		}
+		return errors.New(cerr.String())
+	}
+
+	result := res.GetResult()
+	if result == nil {
+		return ErrNilResult
+	}
+
+	return nil
+}
+
 // ControllerPublishVolume issues a
 // ControllerPublishVolume request
 // to a CSI controller.
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// NewServerTLSConfig returns the TLS configuration of a server presenting the
+// certificate and key files. Client certificates signed by the client CA file
+// are verified when it is set, and required when requireClientCert is true.
+// The files are reloaded on the first handshake after one of them changed, a
+// reload that fails keeps the files loaded before.
+func NewServerTLSConfig(certFile, keyFile, clientCAFile string, requireClientCert bool) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("error tls requires a certificate and a key file")
+	}
+	if requireClientCert && clientCAFile == "" {
+		return nil, fmt.Errorf("error client certificates cannot be required without a client ca file")
+	}
+	r := &serverTLSReloader{
+		certFile:          certFile,
+		keyFile:           keyFile,
+		clientCAFile:      clientCAFile,
+		requireClientCert: requireClientCert,
+	}
+	if err := r.reload(); err != nil {
+		return nil, err
+	}
+	return &tls.Config{GetConfigForClient: r.getConfigForClient}, nil
+}
+
+// serverTLSReloader keeps the server configuration built from the files
+// along with the modification times of the files it was built from
+type serverTLSReloader struct {
+	sync.Mutex
+	certFile          string
+	keyFile           string
+	clientCAFile      string
+	requireClientCert bool
+	modTimes          []time.Time
+	config            *tls.Config
+}
+
+func (r *serverTLSReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.Lock()
+	defer r.Unlock()
+	if modTimes, err := r.currentModTimes(); err == nil && !equalTimes(modTimes, r.modTimes) {
+		if err := r.reload(); err != nil {
+			log.Printf("error reloading tls files, keeping the loaded ones: %v", err)
+		}
+	}
+	return r.config, nil
+}
+
+func (r *serverTLSReloader) files() []string {
+	files := []string{r.certFile, r.keyFile}
+	if r.clientCAFile != "" {
+		files = append(files, r.clientCAFile)
+	}
+	return files
+}
+
+func (r *serverTLSReloader) currentModTimes() ([]time.Time, error) {
+	modTimes := []time.Time{}
+	for _, file := range r.files() {
+		info, err := os.Stat(file)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, info.ModTime())
+	}
+	return modTimes, nil
+}
+
+func (r *serverTLSReloader) reload() error {
+	modTimes, err := r.currentModTimes()
+	if err != nil {
+		return fmt.Errorf("error reading tls files: %v", err)
+	}
+	cert, err := tls.LoadX509KeyPair(r.certFile, r.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading tls certificate: %v", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		// the returned configuration replaces the one of grpc which negotiates http2
+		NextProtos: []string{"h2"},
+		MinVersion: tls.VersionTLS12,
+	}
+	if r.clientCAFile != "" {
+		if config.ClientCAs, err = loadCertPool(r.clientCAFile); err != nil {
+			return err
+		}
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+		if r.requireClientCert {
+			config.ClientAuth = tls.RequireAndVerifyClientCert
+		}
+	}
+	r.config = config
+	r.modTimes = modTimes
+	return nil
+}
+
+// NewClientTLSConfig returns the TLS configuration of a client verifying the
+// server of serverName with the CA file, the system roots when it is empty, and
+// presenting the certificate and key files when they are set.
+func NewClientTLSConfig(caFile, certFile, keyFile, serverName string) (*tls.Config, error) {
+	config := &tls.Config{ServerName: serverName, MinVersion: tls.VersionTLS12}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading tls client certificate: %v", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("error reading ca file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("error no certificate found in ca file %s", caFile)
+	}
+	return pool, nil
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
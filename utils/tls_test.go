@@ -0,0 +1,190 @@
+package utils
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+// writeCertificate writes name.crt and name.key for localhost and 127.0.0.1, signed by
+// the parent or self signed as a CA when the parent is nil
+func writeCertificate(dir string, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	Expect(err).ToNot(HaveOccurred())
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	Expect(err).ToNot(HaveOccurred())
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(ioutil.WriteFile(filepath.Join(dir, name+".crt"), pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)).To(Succeed())
+	Expect(ioutil.WriteFile(filepath.Join(dir, name+".key"), pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600)).To(Succeed())
+	cert, err := x509.ParseCertificate(der)
+	Expect(err).ToNot(HaveOccurred())
+	return cert, key
+}
+
+var _ = Describe("TLS", func() {
+
+	var (
+		dir      string
+		listener net.Listener
+	)
+	file := func(name string) string {
+		return filepath.Join(dir, name)
+	}
+	// serve accepts TLS connections and greets the clients that complete the handshake
+	serve := func(config *tls.Config) string {
+		var err error
+		listener, err = tls.Listen("tcp", "127.0.0.1:0", config)
+		Expect(err).ToNot(HaveOccurred())
+		go func() {
+			for {
+				conn, err := listener.Accept()
+				if err != nil {
+					return
+				}
+				go func() {
+					defer conn.Close()
+					conn.Write([]byte("hello"))
+				}()
+			}
+		}()
+		return listener.Addr().String()
+	}
+	// dial returns the common name of the server once it greeted the client
+	dial := func(addr string, config *tls.Config) (string, error) {
+		conn, err := tls.Dial("tcp", addr, config)
+		if err != nil {
+			return "", err
+		}
+		defer conn.Close()
+		if _, err := ioutil.ReadAll(conn); err != nil {
+			return "", err
+		}
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName, nil
+	}
+	// replace overwrites the server files with the other ones and moves their modification time forward
+	replace := func(certFile, keyFile string) {
+		for source, target := range map[string]string{certFile: "server.crt", keyFile: "server.key"} {
+			content, err := ioutil.ReadFile(file(source))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ioutil.WriteFile(file(target), content, 0600)).To(Succeed())
+			later := time.Now().Add(time.Minute)
+			Expect(os.Chtimes(file(target), later, later)).To(Succeed())
+		}
+	}
+
+	BeforeEach(func() {
+		var err error
+		dir, err = ioutil.TempDir("", "ubiquity-csi-tls")
+		Expect(err).ToNot(HaveOccurred())
+		ca, caKey := writeCertificate(dir, "ca", nil, nil)
+		writeCertificate(dir, "server", ca, caKey)
+		writeCertificate(dir, "rotated", ca, caKey)
+		writeCertificate(dir, "client", ca, caKey)
+		listener = nil
+	})
+	AfterEach(func() {
+		if listener != nil {
+			listener.Close()
+		}
+		os.RemoveAll(dir)
+	})
+
+	Context(".NewServerTLSConfig", func() {
+		It("Should fail without a certificate and a key", func() {
+			_, err := NewServerTLSConfig(file("server.crt"), "", "", false)
+			Expect(err).To(HaveOccurred())
+			_, err = NewServerTLSConfig(file("server.crt"), file("missing.key"), "", false)
+			Expect(err).To(HaveOccurred())
+			_, err = NewServerTLSConfig(file("server.crt"), file("client.key"), "", false)
+			Expect(err).To(MatchError(ContainSubstring("error loading tls certificate")))
+		})
+		It("Should fail to require client certificates without a client ca", func() {
+			_, err := NewServerTLSConfig(file("server.crt"), file("server.key"), "", true)
+			Expect(err).To(HaveOccurred())
+			_, err = NewServerTLSConfig(file("server.crt"), file("server.key"), file("server.key"), true)
+			Expect(err).To(MatchError(ContainSubstring("no certificate found")))
+		})
+		It("Should reject the clients without a certificate when it is required", func() {
+			config, err := NewServerTLSConfig(file("server.crt"), file("server.key"), file("ca.crt"), true)
+			Expect(err).ToNot(HaveOccurred())
+			addr := serve(config)
+			withCert, err := NewClientTLSConfig(file("ca.crt"), file("client.crt"), file("client.key"), "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dial(addr, withCert)).To(Equal("server"))
+			withoutCert, err := NewClientTLSConfig(file("ca.crt"), "", "", "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = dial(addr, withoutCert)
+			Expect(err).To(HaveOccurred())
+		})
+		It("Should accept the clients without a certificate when it is not required", func() {
+			config, err := NewServerTLSConfig(file("server.crt"), file("server.key"), file("ca.crt"), false)
+			Expect(err).ToNot(HaveOccurred())
+			addr := serve(config)
+			withoutCert, err := NewClientTLSConfig(file("ca.crt"), "", "", "localhost")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dial(addr, withoutCert)).To(Equal("server"))
+		})
+		It("Should reload the certificate when its files change and keep it when they are broken", func() {
+			config, err := NewServerTLSConfig(file("server.crt"), file("server.key"), "", false)
+			Expect(err).ToNot(HaveOccurred())
+			addr := serve(config)
+			client, err := NewClientTLSConfig(file("ca.crt"), "", "", "127.0.0.1")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(dial(addr, client)).To(Equal("server"))
+
+			replace("rotated.crt", "rotated.key")
+			Expect(dial(addr, client)).To(Equal("rotated"))
+
+			replace("ca.key", "ca.key")
+			Expect(dial(addr, client)).To(Equal("rotated"))
+		})
+	})
+
+	Context(".NewClientTLSConfig", func() {
+		It("Should refuse a server certificate issued for another name", func() {
+			config, err := NewServerTLSConfig(file("server.crt"), file("server.key"), "", false)
+			Expect(err).ToNot(HaveOccurred())
+			addr := serve(config)
+			client, err := NewClientTLSConfig(file("ca.crt"), "", "", "ubiquity.example.com")
+			Expect(err).ToNot(HaveOccurred())
+			_, err = dial(addr, client)
+			Expect(err).To(HaveOccurred())
+		})
+		It("Should fail on a missing ca file or a certificate without its key", func() {
+			_, err := NewClientTLSConfig(file("missing.crt"), "", "", "localhost")
+			Expect(err).To(MatchError(ContainSubstring("error reading ca file")))
+			_, err = NewClientTLSConfig(file("ca.crt"), file("client.crt"), "", "localhost")
+			Expect(err).To(MatchError(ContainSubstring("error loading tls client certificate")))
+		})
+	})
+})
@@ -2,9 +2,16 @@ package utils
 
 import (
 	"fmt"
+	"io/ioutil"
 	"net"
 	"os"
+	"os/user"
+	"path/filepath"
 	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 )
 
 // Version is a type that responds with Major, Minor, and Patch
@@ -70,13 +77,150 @@ func GetCSIEndpoint() (network, addr string, err error) {
 }
 
 // GetCSIEndpointListener returns the net.Listener for the endpoint
-// specified by the environment variable CSI_ENDPOINT.
+// specified by the environment variable CSI_ENDPOINT. The socket of a unix
+// endpoint gets the mode and the owner given by CSI_ENDPOINT_PERMS,
+// CSI_ENDPOINT_USER and CSI_ENDPOINT_GROUP before it is reachable.
 func GetCSIEndpointListener() (net.Listener, error) {
 	proto, addr, err := GetCSIEndpoint()
 	if err != nil {
 		return nil, err
 	}
-	return net.Listen(proto, addr)
+	if !isUnixProto(proto) {
+		return net.Listen(proto, addr)
+	}
+	if err := os.MkdirAll(filepath.Dir(addr), 0755); err != nil {
+		return nil, fmt.Errorf("error creating csi endpoint directory: %v", err)
+	}
+	if err := removeStaleSocket(proto, addr); err != nil {
+		return nil, err
+	}
+	return listenPrivate(proto, addr)
+}
+
+func isUnixProto(proto string) bool {
+	return strings.HasPrefix(strings.ToLower(proto), "unix")
+}
+
+// listenPrivate creates the socket in a directory only the plugin can enter and
+// renames it to the endpoint once its mode and owner are set, so that the socket
+// is never reachable with the permissions of the umask
+func listenPrivate(proto, addr string) (net.Listener, error) {
+	dir, err := ioutil.TempDir(filepath.Dir(addr), ".csi")
+	if err != nil {
+		return nil, fmt.Errorf("error creating csi endpoint directory: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	privateAddr := filepath.Join(dir, "csi.sock")
+	l, err := net.Listen(proto, privateAddr)
+	if err != nil {
+		return nil, err
+	}
+	if err := setSocketAccess(privateAddr); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if err := os.Rename(privateAddr, addr); err != nil {
+		l.Close()
+		return nil, fmt.Errorf("error moving csi endpoint in place: %v", err)
+	}
+	return l, nil
+}
+
+// staleSocketDialTimeout bounds the check for a process listening on an existing socket
+const staleSocketDialTimeout = time.Second
+
+// removeStaleSocket removes the socket file left by a previous run, the socket is
+// stale only when connecting to it is refused. A socket another process listens on,
+// a socket that cannot be checked and a file that is not a socket are kept.
+func removeStaleSocket(proto, addr string) error {
+	info, err := os.Lstat(addr)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if info.Mode()&os.ModeSocket == 0 {
+		return fmt.Errorf("error csi endpoint %s exists and is not a socket", addr)
+	}
+	conn, err := net.DialTimeout(proto, addr, staleSocketDialTimeout)
+	if err == nil {
+		conn.Close()
+		return fmt.Errorf("error csi endpoint %s is in use by another process", addr)
+	}
+	if !isConnectionRefused(err) {
+		return fmt.Errorf("error checking csi endpoint %s: %v", addr, err)
+	}
+	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error removing stale csi endpoint %s: %v", addr, err)
+	}
+	return nil
+}
+
+func isConnectionRefused(err error) bool {
+	if opErr, ok := err.(*net.OpError); ok {
+		err = opErr.Err
+	}
+	if sysErr, ok := err.(*os.SyscallError); ok {
+		err = sysErr.Err
+	}
+	return err == syscall.ECONNREFUSED
+}
+
+// setSocketAccess applies CSI_ENDPOINT_PERMS, an octal mode, and CSI_ENDPOINT_USER
+// and CSI_ENDPOINT_GROUP, names or numeric ids, to the socket file.
+func setSocketAccess(addr string) error {
+	if perms := os.Getenv("CSI_ENDPOINT_PERMS"); perms != "" {
+		mode, err := strconv.ParseUint(perms, 8, 32)
+		if err != nil {
+			return fmt.Errorf("error invalid CSI_ENDPOINT_PERMS %s: %v", perms, err)
+		}
+		if err := os.Chmod(addr, os.FileMode(mode)); err != nil {
+			return fmt.Errorf("error setting csi endpoint permissions: %v", err)
+		}
+	}
+	uid, err := lookupID(os.Getenv("CSI_ENDPOINT_USER"), func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+	if err != nil {
+		return fmt.Errorf("error invalid CSI_ENDPOINT_USER: %v", err)
+	}
+	gid, err := lookupID(os.Getenv("CSI_ENDPOINT_GROUP"), func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+	if err != nil {
+		return fmt.Errorf("error invalid CSI_ENDPOINT_GROUP: %v", err)
+	}
+	if uid == -1 && gid == -1 {
+		return nil
+	}
+	if err := os.Chown(addr, uid, gid); err != nil {
+		return fmt.Errorf("error setting csi endpoint owner: %v", err)
+	}
+	return nil
+}
+
+// lookupID returns the numeric id of a user or group name, -1 when it is empty.
+func lookupID(name string, lookup func(string) (string, error)) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return -1, err
+	}
+	return strconv.Atoi(id)
 }
 
 var addrRX = regexp.MustCompile(
@@ -90,3 +234,16 @@ func ParseProtoAddr(protoAddr string) (proto string, addr string, err error) {
 	}
 	return m[1], m[2], nil
 }
+
+// RemoveCSIEndpointSocket removes the socket file of a unix endpoint
+// specified by the environment variable CSI_ENDPOINT.
+func RemoveCSIEndpointSocket() error {
+	proto, addr, err := GetCSIEndpoint()
+	if err != nil || !isUnixProto(proto) {
+		return err
+	}
+	if err := os.Remove(addr); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
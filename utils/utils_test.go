@@ -0,0 +1,111 @@
+package utils
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"syscall"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Utils", func() {
+
+	Context(".GetCSIEndpointListener", func() {
+		var (
+			dir  string
+			addr string
+		)
+		BeforeEach(func() {
+			var err error
+			dir, err = ioutil.TempDir("", "ubiquity-csi-endpoint")
+			Expect(err).ToNot(HaveOccurred())
+			addr = filepath.Join(dir, "plugin", "csi.sock")
+			os.Setenv("CSI_ENDPOINT", "unix://"+addr)
+		})
+		AfterEach(func() {
+			os.Unsetenv("CSI_ENDPOINT")
+			os.Unsetenv("CSI_ENDPOINT_PERMS")
+			os.Unsetenv("CSI_ENDPOINT_USER")
+			os.Unsetenv("CSI_ENDPOINT_GROUP")
+			os.RemoveAll(dir)
+		})
+		It("Should create the socket and its directory without leaving anything else behind", func() {
+			l, err := GetCSIEndpointListener()
+			Expect(err).ToNot(HaveOccurred())
+			defer l.Close()
+			info, err := os.Lstat(addr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode() & os.ModeSocket).ToNot(BeZero())
+			files, err := ioutil.ReadDir(filepath.Dir(addr))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(HaveLen(1))
+			conn, err := net.Dial("unix", addr)
+			Expect(err).ToNot(HaveOccurred())
+			conn.Close()
+		})
+		It("Should replace a stale socket nobody listens on", func() {
+			Expect(os.MkdirAll(filepath.Dir(addr), 0755)).To(Succeed())
+			stale, err := net.Listen("unix", addr)
+			Expect(err).ToNot(HaveOccurred())
+			stale.(*net.UnixListener).SetUnlinkOnClose(false)
+			stale.Close()
+			l, err := GetCSIEndpointListener()
+			Expect(err).ToNot(HaveOccurred())
+			l.Close()
+		})
+		It("Should keep a socket another process listens on", func() {
+			Expect(os.MkdirAll(filepath.Dir(addr), 0755)).To(Succeed())
+			live, err := net.Listen("unix", addr)
+			Expect(err).ToNot(HaveOccurred())
+			defer live.Close()
+			_, err = GetCSIEndpointListener()
+			Expect(err).To(MatchError(ContainSubstring("in use by another process")))
+			conn, err := net.Dial("unix", addr)
+			Expect(err).ToNot(HaveOccurred())
+			conn.Close()
+		})
+		It("Should keep a file that is not a socket", func() {
+			Expect(os.MkdirAll(filepath.Dir(addr), 0755)).To(Succeed())
+			Expect(ioutil.WriteFile(addr, []byte("data"), 0600)).To(Succeed())
+			_, err := GetCSIEndpointListener()
+			Expect(err).To(MatchError(ContainSubstring("is not a socket")))
+			Expect(ioutil.ReadFile(addr)).To(Equal([]byte("data")))
+		})
+		It("Should set the mode and the owner of the socket", func() {
+			os.Setenv("CSI_ENDPOINT_PERMS", "0660")
+			os.Setenv("CSI_ENDPOINT_USER", "1234")
+			os.Setenv("CSI_ENDPOINT_GROUP", "2345")
+			l, err := GetCSIEndpointListener()
+			if os.Getuid() != 0 {
+				Expect(err).To(MatchError(ContainSubstring("error setting csi endpoint owner")))
+				return
+			}
+			Expect(err).ToNot(HaveOccurred())
+			defer l.Close()
+			info, err := os.Lstat(addr)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(info.Mode().Perm()).To(Equal(os.FileMode(0660)))
+			Expect(info.Sys().(*syscall.Stat_t).Uid).To(Equal(uint32(1234)))
+			Expect(info.Sys().(*syscall.Stat_t).Gid).To(Equal(uint32(2345)))
+		})
+		It("Should fail on an invalid mode without leaving a socket behind", func() {
+			os.Setenv("CSI_ENDPOINT_PERMS", "rw-rw----")
+			_, err := GetCSIEndpointListener()
+			Expect(err).To(MatchError(ContainSubstring("invalid CSI_ENDPOINT_PERMS")))
+			files, err := ioutil.ReadDir(filepath.Dir(addr))
+			Expect(err).ToNot(HaveOccurred())
+			Expect(files).To(BeEmpty())
+		})
+	})
+
+	Context(".isConnectionRefused", func() {
+		It("Should only take a refused connection for a stale socket", func() {
+			Expect(isConnectionRefused(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)})).To(BeTrue())
+			Expect(isConnectionRefused(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EACCES)})).To(BeFalse())
+			Expect(isConnectionRefused(&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ETIMEDOUT)})).To(BeFalse())
+		})
+	})
+})